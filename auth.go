@@ -0,0 +1,375 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role access level of a user or api token
+type Role string
+
+const (
+	// RoleNone no access, only the capture endpoints
+	RoleNone Role = ""
+
+	// RoleRead may view sessions, bins and responders
+	RoleRead Role = "read"
+
+	// RoleAdmin may also edit responders and bins, purge sessions, replay, resend and manage users and tokens
+	RoleAdmin Role = "admin"
+)
+
+// ParseRole parse a role name
+func ParseRole(value string) (Role, error) {
+	switch Role(strings.ToLower(value)) {
+	case RoleRead:
+		return RoleRead, nil
+	case RoleAdmin:
+		return RoleAdmin, nil
+	}
+	return RoleNone, fmt.Errorf("invalid role %q, expected read or admin", value)
+}
+
+// Allows returns true if the role grants the access of the required role
+func (r Role) Allows(required Role) bool {
+	return r.level() >= required.level()
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleRead:
+		return 1
+	case RoleAdmin:
+		return 2
+	}
+	return 0
+}
+
+// User struct to store a user that can log in to the web ui or use basic auth
+type User struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	Role         Role      `json:"role"`
+	Created      time.Time `json:"created"`
+}
+
+// APIToken struct to store an api token, only the sha256 of the token is kept
+type APIToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Prefix  string    `json:"prefix"`
+	Role    Role      `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+// AuthStore thread safe registry of the users and api tokens, backed by the AuthBucket
+type AuthStore struct {
+	mu     sync.RWMutex
+	users  map[string]*User
+	tokens map[string]*APIToken
+}
+
+var (
+	// Auth registry of users and api tokens
+	Auth = &AuthStore{users: make(map[string]*User), tokens: make(map[string]*APIToken)}
+)
+
+// InitializeAuth loads the users and api tokens from the db
+func InitializeAuth() error {
+	users, tokens, err := LoadAuth()
+	if err != nil {
+		return err
+	}
+
+	Auth.mu.Lock()
+	defer Auth.mu.Unlock()
+	for _, u := range users {
+		Auth.users[u.Name] = u
+	}
+	for _, t := range tokens {
+		Auth.tokens[t.Name] = t
+	}
+
+	if *authEnabled && len(users) == 0 && len(tokens) == 0 {
+		fmt.Printf("Auth is enabled and no users or tokens exist, create one with: dumpr user add <name> --password <password> --role admin\n")
+	}
+	return nil
+}
+
+// AddUser creates or replaces a user
+func (a *AuthStore) AddUser(name, password string, role Role) (*User, error) {
+	if name == "" || password == "" {
+		return nil, fmt.Errorf("user name and password are required")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{Name: name, PasswordHash: string(hash), Role: role, Created: time.Now()}
+	err = storeAuthRecord("user/"+name, user)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.users[name] = user
+	a.mu.Unlock()
+	return user, nil
+}
+
+// RemoveUser deletes a user
+func (a *AuthStore) RemoveUser(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[name]; !ok {
+		return fmt.Errorf("user %s not found", name)
+	}
+	delete(a.users, name)
+	return deleteAuthRecord("user/" + name)
+}
+
+// Users returns the users sorted by name, without the password hashes
+func (a *AuthStore) Users() []*User {
+	a.mu.RLock()
+	list := make([]*User, 0, len(a.users))
+	for _, u := range a.users {
+		list = append(list, &User{Name: u.Name, Role: u.Role, Created: u.Created})
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Login returns the user if the password is valid
+func (a *AuthStore) Login(name, password string) (*User, bool) {
+	a.mu.RLock()
+	user, ok := a.users[name]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// CreateToken creates a new api token, the token value is only returned here
+func (a *AuthStore) CreateToken(name string, role Role) (string, *APIToken, error) {
+	if name == "" {
+		return "", nil, fmt.Errorf("token name is required")
+	}
+
+	a.mu.RLock()
+	_, exists := a.tokens[name]
+	a.mu.RUnlock()
+	if exists {
+		return "", nil, fmt.Errorf("token %s already exists", name)
+	}
+
+	secret := make([]byte, 24)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", nil, err
+	}
+	value := "dumpr_" + hex.EncodeToString(secret)
+
+	token := &APIToken{Name: name, Hash: hashToken(value), Prefix: value[:12], Role: role, Created: time.Now()}
+	err = storeAuthRecord("token/"+name, token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	a.mu.Lock()
+	a.tokens[name] = token
+	a.mu.Unlock()
+	return value, token, nil
+}
+
+// RevokeToken deletes an api token
+func (a *AuthStore) RevokeToken(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.tokens[name]; !ok {
+		return fmt.Errorf("token %s not found", name)
+	}
+	delete(a.tokens, name)
+	return deleteAuthRecord("token/" + name)
+}
+
+// Tokens returns the api tokens sorted by name, without the hashes
+func (a *AuthStore) Tokens() []*APIToken {
+	a.mu.RLock()
+	list := make([]*APIToken, 0, len(a.tokens))
+	for _, t := range a.tokens {
+		list = append(list, &APIToken{Name: t.Name, Prefix: t.Prefix, Role: t.Role, Created: t.Created})
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Token returns the api token matching the token value
+func (a *AuthStore) Token(value string) (*APIToken, bool) {
+	hash := hashToken(value)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashBinSecret returns the hash of a bin secret, salted with the bin name
+func hashBinSecret(bin, secret string) string {
+	return hashToken(bin + ":" + secret)
+}
+
+// CheckSecret returns true if the secret matches the secret of the bin
+func (b *Bin) CheckSecret(secret string) bool {
+	if b.SecretHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(b.SecretHash), []byte(hashBinSecret(b.Name, secret))) == 1
+}
+
+func storeAuthRecord(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return store.PutRecord(AuthBucket, key, raw)
+}
+
+func deleteAuthRecord(key string) error {
+	return store.DeleteRecord(AuthBucket, key)
+}
+
+// LoadAuth load the users and api tokens from the AuthBucket
+func LoadAuth() ([]*User, []*APIToken, error) {
+	users := make([]*User, 0)
+	tokens := make([]*APIToken, 0)
+
+	err := store.ForEachRecord(AuthBucket, func(k string, v []byte) error {
+		switch {
+		case strings.HasPrefix(k, "user/"):
+			u := &User{}
+			if err := json.Unmarshal(v, u); err != nil {
+				fmt.Printf("LoadAuth: %s - error decoding user %v\n", k, err)
+				return nil
+			}
+			users = append(users, u)
+		case strings.HasPrefix(k, "token/"):
+			t := &APIToken{}
+			if err := json.Unmarshal(v, t); err != nil {
+				fmt.Printf("LoadAuth: %s - error decoding token %v\n", k, err)
+				return nil
+			}
+			tokens = append(tokens, t)
+		}
+		return nil
+	})
+	return users, tokens, err
+}
+
+// runUserCommand implements `dumpr user add|remove|list`
+func runUserCommand(args []string) error {
+	usage := fmt.Errorf("usage: dumpr user add <name> --password <password> [--role read|admin] | remove <name> | list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		role, err := ParseRole(*authRole)
+		if err != nil {
+			return err
+		}
+		_, err = Auth.AddUser(args[1], *authPassword, role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("User %s added with role %s\n", args[1], role)
+		return nil
+	case args[0] == "remove" && len(args) == 2:
+		err := Auth.RemoveUser(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("User %s removed\n", args[1])
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		for _, u := range Auth.Users() {
+			fmt.Printf("%-20s %-6s %s\n", u.Name, u.Role, u.Created.Format(time.RFC3339))
+		}
+		return nil
+	}
+	return usage
+}
+
+// runTokenCommand implements `dumpr token create|revoke|list`
+func runTokenCommand(args []string) error {
+	usage := fmt.Errorf("usage: dumpr token create <name> [--role read|admin] | revoke <name> | list")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		role, err := ParseRole(*authRole)
+		if err != nil {
+			return err
+		}
+		value, _, err := Auth.CreateToken(args[1], role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %s created with role %s, it will not be shown again:\n%s\n", args[1], role, value)
+		return nil
+	case args[0] == "revoke" && len(args) == 2:
+		err := Auth.RevokeToken(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %s revoked\n", args[1])
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		for _, t := range Auth.Tokens() {
+			fmt.Printf("%-20s %-6s %s... %s\n", t.Name, t.Role, t.Prefix, t.Created.Format(time.RFC3339))
+		}
+		return nil
+	}
+	return usage
+}
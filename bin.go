@@ -0,0 +1,243 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binNameRegex valid bin names, usable as a path segment and a dns label
+var binNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]{0,62}$`)
+
+// Bin struct to store a named capture bin. Requests sent to /b/<name>/... or <name>.<binDomain> are captured as
+// sessions of the bin, matched against the bin responders before the global autoresponders. When auth is enabled the
+// bin secret grants read access to the sessions of the bin only.
+type Bin struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Created     time.Time       `json:"created"`
+	Retention   string          `json:"retention"`
+	Responders  []*AutoResponse `json:"responders"`
+	Secret      string          `json:"secret,omitempty"`
+	ClearSecret bool            `json:"clearSecret,omitempty"`
+	SecretHash  string          `json:"secretHash,omitempty"`
+	Protected   bool            `json:"protected"`
+	retention   time.Duration
+}
+
+// Init initialize struct, validates the name and retention
+func (b *Bin) Init() error {
+	if !binNameRegex.MatchString(b.Name) {
+		return fmt.Errorf("invalid bin name %q", b.Name)
+	}
+
+	if b.Created.IsZero() {
+		b.Created = time.Now()
+	}
+
+	b.retention = 0
+	if b.Retention != "" {
+		retention, err := time.ParseDuration(b.Retention)
+		if err != nil {
+			return fmt.Errorf("invalid retention %q: %v", b.Retention, err)
+		}
+		b.retention = retention
+	}
+
+	if b.Secret != "" {
+		b.SecretHash = hashBinSecret(b.Name, b.Secret)
+		b.Secret = ""
+	}
+	b.Protected = b.SecretHash != ""
+
+	if b.Responders == nil {
+		b.Responders = make([]*AutoResponse, 0)
+	}
+	for _, r := range b.Responders {
+		r.Init()
+	}
+	sort.SliceStable(b.Responders, func(i, j int) bool {
+		return b.Responders[i].Index < b.Responders[j].Index
+	})
+	return nil
+}
+
+// RetentionDuration returns how long sessions of the bin are kept, 0 uses the --purgeOlderThan value
+func (b *Bin) RetentionDuration() time.Duration {
+	return b.retention
+}
+
+// Find attempts to find a bin responder matching the http.Request
+func (b *Bin) Find(req *http.Request) *AutoResponse {
+	for _, r := range b.Responders {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// URL returns the capture url of the bin
+func (b *Bin) URL() string {
+	return fmt.Sprintf("%s/b/%s", *publicUrl, b.Name)
+}
+
+// Public returns a copy of the Bin without the secret hash, to be returned via web service
+func (b *Bin) Public() *Bin {
+	public := *b
+	public.SecretHash = ""
+	return &public
+}
+
+// Bytes returns the bytes of the json formatted of the Bin
+func (b *Bin) Bytes() []byte {
+	dump, _ := json.MarshalIndent(b, "", "    ")
+	return dump
+}
+
+// BinStore thread safe registry of the named bins
+type BinStore struct {
+	mu   sync.RWMutex
+	bins map[string]*Bin
+}
+
+var (
+	// Bins registry of all bins
+	Bins = &BinStore{bins: make(map[string]*Bin)}
+)
+
+// Get returns the bin for the name
+func (r *BinStore) Get(name string) (*Bin, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.bins[strings.ToLower(name)]
+	return b, ok
+}
+
+// GetOrTag returns the bin for the name. A name no bin was created for through the api is a tag, an empty bin is
+// returned that is neither stored nor added to the registry, capturing into a tag does not create a bin.
+func (r *BinStore) GetOrTag(name string) (*Bin, error) {
+	b, ok := r.Get(name)
+	if ok {
+		return b, nil
+	}
+
+	b = &Bin{Name: strings.ToLower(name)}
+	err := b.Init()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Put validates and stores the bin, replacing an existing bin of the same name. The secret of an existing bin is kept
+// if b does not set one, unless b sets ClearSecret.
+func (r *BinStore) Put(b *Bin) error {
+	b.Name = strings.ToLower(b.Name)
+	b.SecretHash = ""
+	if b.ClearSecret && b.Secret != "" {
+		return fmt.Errorf("secret and clearSecret can not both be set")
+	}
+	err := b.Init()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.bins[b.Name]; ok {
+		b.Created = existing.Created
+		if b.SecretHash == "" && !b.ClearSecret {
+			b.SecretHash = existing.SecretHash
+			b.Protected = b.SecretHash != ""
+		}
+	}
+	b.ClearSecret = false
+
+	err = StoreBin(b)
+	if err != nil {
+		return err
+	}
+	r.bins[b.Name] = b
+	return nil
+}
+
+// Delete removes the bin, sessions captured in the bin are kept
+func (r *BinStore) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = strings.ToLower(name)
+	delete(r.bins, name)
+	return DeleteBin(name)
+}
+
+// List returns a snapshot of the bins sorted by name
+func (r *BinStore) List() []*Bin {
+	r.mu.RLock()
+	list := make([]*Bin, 0, len(r.bins))
+	for _, v := range r.bins {
+		list = append(list, v)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// InitializeBins loads the bins from the db
+func InitializeBins() error {
+	list, err := LoadBins()
+	if err != nil {
+		return err
+	}
+
+	Bins.mu.Lock()
+	defer Bins.mu.Unlock()
+	for _, b := range list {
+		Bins.bins[b.Name] = b
+	}
+	fmt.Printf("Loaded %d bins\n", len(list))
+	return nil
+}
+
+// BinFromHost returns the bin name of a <bin>.<binDomain> host, or an empty string if the host is not a bin host.
+func BinFromHost(host string) string {
+	if *binDomain == "" {
+		return ""
+	}
+
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+
+	suffix := "." + strings.ToLower(*binDomain)
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+
+	name := strings.TrimSuffix(host, suffix)
+	if !binNameRegex.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// binFilter returns a session filter matching the sessions of a bin that pass filter, a nil filter matches all
+func binFilter(bin string, filter func(s *Session) bool) func(s *Session) bool {
+	bin = strings.ToLower(bin)
+	return func(s *Session) bool {
+		return s.BinName() == bin && (filter == nil || filter(s))
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCaptureIntoTagDoesNotCreateBin(t *testing.T) {
+	setupTestServer(t)
+	routerURL := serveTestRouter(t)
+
+	res, err := http.Post(routerURL+"/b/Adhoc/hook", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("capture returned %d", res.StatusCode)
+	}
+
+	if len(Sessions.Lookup([]string{"bin=adhoc"})) != 1 {
+		t.Errorf("session not captured into the adhoc tag")
+	}
+	if _, ok := Bins.Get("adhoc"); ok {
+		t.Errorf("capture created the adhoc bin")
+	}
+	stored, err := LoadBins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("capture stored %d bins", len(stored))
+	}
+
+	res, err = http.Post(routerURL+"/b/not_a_bin", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid bin name returned %d, want 400", res.StatusCode)
+	}
+}
@@ -6,160 +6,174 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"sort"
-	"time"
 )
 
-// SessionBucket bucket name for boltdb storage
+// SessionBucket bucket name for storage of sessions
 const SessionBucket = "Sessions"
 
-// RespondersBucket bucket name for boltdb storage
+// RespondersBucket bucket name for storage of autoresponders
 const RespondersBucket = "Responders"
 
+// BinsBucket bucket name for storage of named bins
+const BinsBucket = "Bins"
+
+// AuthBucket bucket name for storage of users and api tokens
+const AuthBucket = "Auth"
+
+// MetaBucket bucket name for storage of db format details
+const MetaBucket = "Meta"
+
 var (
-	db *bolt.DB
+	store Storage
 )
 
-// InitializeDB initialize boltdb, returns db reference and error
-func InitializeDB() (*bolt.DB, error) {
-	// Open the dumpr.db data file in your current directory.
-	// It will be created if it doesn't exist.
+// InitializeDB opens the storage backend selected with --storage, creates the default autoresponders on first use and
+// migrates the session keys.
+func InitializeDB() (Storage, error) {
 	var err error
-
-	filename := fmt.Sprintf("%s/dumpr.db", *saveDir)
-
-	db, err = bolt.Open(filename, 0600, &bolt.Options{
-		Timeout: 5 * time.Second,
-	})
+	store, err = OpenStorage(*storageBackend, *saveDir)
 	if err != nil {
-		fmt.Printf("Unable to open boltdb error: %v\n", err)
+		fmt.Printf("Unable to open %s storage error: %v\n", *storageBackend, err)
 		return nil, err
 	}
 
-	fmt.Printf("Opened dumpr.db data file\n")
-
-	_ = db.Update(func(tx *bolt.Tx) error {
-		_, _ = tx.CreateBucket([]byte(SessionBucket))
-		// ignore bucket already created error
-		return nil
-	})
-
-	createDefaults := false
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte(RespondersBucket))
-		if err == nil {
-			createDefaults = true
-		}
-		return nil
-	})
-
-	if createDefaults {
-		// empty bucket on first call.
-		responses := CreateDefaultRules()
-		for _, val := range responses {
-			_ = StoreResponder(val)
+	_, err = store.GetRecord(MetaBucket, "defaultResponders")
+	if errors.Is(err, ErrNotFound) {
+		count := 0
+		_ = store.ForEachResponder(func(name string, raw []byte) error {
+			count++
+			return nil
+		})
+
+		if count == 0 {
+			// empty store on first call.
+			responses := CreateDefaultRules()
+			for _, val := range responses {
+				_ = StoreResponder(val)
+			}
 		}
+		err = store.PutRecord(MetaBucket, "defaultResponders", []byte("true"))
+	}
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
 
+	err = MigrateSessionKeys()
+	if err != nil {
+		fmt.Printf("Unable to migrate session keys error: %v\n", err)
+		_ = store.Close()
+		return nil, err
 	}
 
-	return db, err
+	return store, nil
 }
 
-// StoreSession store a session within the boltdb bucket
+// StoreSession store a session in the storage backend, a purged session is not stored again. The session is read
+// locked until it is stored so PurgeSession can not delete it in between. Storing records a change of the session for
+// the ETags of the session lists.
 func StoreSession(s *Session) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
-		err := b.Put([]byte(s.Key), s.Bytes())
-		return err
-	})
+	err := storeSession(s)
+	Sessions.Touch()
 	return err
 }
 
-// LoadSession load a session within the boltdb bucket
-func LoadSession(key string) (s *Session, err error) {
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
-		raw := b.Get([]byte(key))
-
-		if raw != nil {
-			s = &Session{}
-			err := json.Unmarshal(raw, s)
-			if err != nil {
-				return err
-			}
+func storeSession(s *Session) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.purged {
+		return nil
+	}
+	dump, _ := json.MarshalIndent(s, "", "    ")
+	return store.PutSession(s.Key, dump)
+}
 
-			var valid bool
-			valid, err = s.IsValid()
-			if !valid || err != nil {
-				return fmt.Errorf("resources missing from session")
-			}
+// LoadSession load a session from the storage backend, returns nil if the session does not exist
+func LoadSession(key string) (*Session, error) {
+	raw, err := store.GetSession(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			if s.Protocol == HTTP {
-				err = s.LoadHTTPRequestJSON()
-				if err != nil {
-					fmt.Printf("LoadSession: %s - error loading LoadHTTPRequestJSON %v\n", key, err)
-				}
-			}
-		}
-		return nil
-	})
+	s := &Session{}
+	err = json.Unmarshal(raw, s)
+	if err != nil {
+		return nil, err
+	}
 
-	return s, err
+	valid, err := s.IsValid()
+	if !valid || err != nil {
+		return s, fmt.Errorf("resources missing from session")
+	}
+
+	if s.Protocol == HTTP {
+		err = s.LoadHTTPRequestJSON()
+		if err != nil {
+			fmt.Printf("LoadSession: %s - error loading LoadHTTPRequestJSON %v\n", key, err)
+		}
+	}
+	if s.Protocol == Mail {
+		err = s.LoadMailJSON()
+		if err != nil {
+			fmt.Printf("LoadSession: %s - error loading LoadMailJSON %v\n", key, err)
+		}
+	}
+	return s, nil
 }
 
-// DeleteSession delete a session within the boltdb bucket
+// DeleteSession delete a session from the storage backend
 func DeleteSession(key string) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
-		return b.Delete([]byte(key))
-	})
-
-	return err
+	return store.DeleteSession(key)
 }
 
-// LoadSessions load a list of sessions from the boltdb bucket
+// LoadSessions load a list of sessions from the storage backend
 func LoadSessions() ([]*Session, error) {
 	listSessions := make([]*Session, 0)
 	invalidSessions := make([]*Session, 0)
 
-	err := db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(SessionBucket))
-		c := b.Cursor()
+	err := store.ForEachSession(func(key string, raw []byte) error {
+		s := &Session{}
+		err := json.Unmarshal(raw, s)
+		if err != nil {
+			return nil
+		}
+
+		valid, err := s.IsValid()
+		if err != nil {
+			invalidSessions = append(invalidSessions, s)
+			fmt.Printf("Session File missing, removing bad session: %v\n", err)
+			return nil
+		}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			s := &Session{}
-			err := json.Unmarshal(v, s)
-			if err == nil {
-				valid, err := s.IsValid()
+		if valid {
+			s.Active = false
+			listSessions = append(listSessions, s)
+			if s.Protocol == HTTP {
+				err = s.LoadHTTPRequestJSON()
 				if err != nil {
-					invalidSessions = append(invalidSessions, s)
-					fmt.Printf("Session File missing, removing bad session: %v\n", err)
-					continue
+					fmt.Printf("LoadSession: %s - error loading LoadHTTPRequestJSON %v\n", s.Key, err)
 				}
-
-				if valid {
-					s.Active = false
-					listSessions = append(listSessions, s)
-					Sessions[s.Key] = s
-					fmt.Printf("Add valid session to InActiveSessions list: %v\n", s.Key)
-
-					if s.Protocol == HTTP {
-						err = s.LoadHTTPRequestJSON()
-						if err != nil {
-							fmt.Printf("LoadSession: %s - error loading LoadHTTPRequestJSON %v\n", s.Key, err)
-						}
-					}
-
-				} else {
-					invalidSessions = append(invalidSessions, s)
-					fmt.Printf("session: %s, valid is false, removing bad session\n", s.Key)
+			}
+			if s.Protocol == Mail {
+				err = s.LoadMailJSON()
+				if err != nil {
+					fmt.Printf("LoadSession: %s - error loading LoadMailJSON %v\n", s.Key, err)
 				}
 			}
-		}
 
+			// the http request and the mail are loaded first, they are part of the search index
+			Sessions.Put(s)
+			fmt.Printf("Add valid session to InActiveSessions list: %v\n", s.Key)
+		} else {
+			invalidSessions = append(invalidSessions, s)
+			fmt.Printf("session: %s, valid is false, removing bad session\n", s.Key)
+		}
 		return nil
 	})
 
@@ -182,64 +196,79 @@ func LoadSessions() ([]*Session, error) {
 	return listSessions, nil
 }
 
-// StoreResponder store a session within the boltdb bucket
-func StoreResponder(s *AutoResponse) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(RespondersBucket))
-		err := b.Put([]byte(s.Name), s.Bytes())
-		return err
-	})
-	return err
+// StoreBin store a bin in the BinsBucket
+func StoreBin(b *Bin) error {
+	return store.PutRecord(BinsBucket, b.Name, b.Bytes())
 }
 
-// LoadResponder load a responder within the boltdb bucket
-func LoadResponder(key string) (s *AutoResponse, err error) {
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(RespondersBucket))
-		raw := b.Get([]byte(key))
-
-		if raw != nil {
-			s = &AutoResponse{}
-			err := json.Unmarshal(raw, s)
-			if err != nil {
-				return err
-			}
-			s.Init()
+// DeleteBin delete a bin from the BinsBucket
+func DeleteBin(name string) error {
+	return store.DeleteRecord(BinsBucket, name)
+}
+
+// LoadBins load the list of bins from the BinsBucket
+func LoadBins() ([]*Bin, error) {
+	bins := make([]*Bin, 0)
+
+	err := store.ForEachRecord(BinsBucket, func(key string, raw []byte) error {
+		b := &Bin{}
+		err := json.Unmarshal(raw, b)
+		if err != nil {
+			fmt.Printf("LoadBins: %s - error decoding bin %v\n", key, err)
+			return nil
+		}
+
+		err = b.Init()
+		if err != nil {
+			fmt.Printf("LoadBins: %s - invalid bin %v\n", key, err)
+			return nil
 		}
+		bins = append(bins, b)
 		return nil
 	})
+	return bins, err
+}
 
-	return s, err
+// StoreResponder store a responder in the storage backend
+func StoreResponder(s *AutoResponse) error {
+	return store.PutResponder(s.Name, s.Bytes())
 }
 
-// DeleteResponder delete a responder within the boltdb bucket
-func DeleteResponder(name string) error {
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(RespondersBucket))
-		return b.Delete([]byte(name))
-	})
+// LoadResponder load a responder from the storage backend, returns nil if the responder does not exist
+func LoadResponder(key string) (*AutoResponse, error) {
+	raw, err := store.GetResponder(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	s := &AutoResponse{}
+	err = json.Unmarshal(raw, s)
+	if err != nil {
+		return nil, err
+	}
+	s.Init()
+	return s, nil
+}
+
+// DeleteResponder delete a responder from the storage backend
+func DeleteResponder(name string) error {
+	return store.DeleteResponder(name)
 }
 
-// LoadResponders load a list of autopresponders from the boltdb bucket
+// LoadResponders load a list of autopresponders from the storage backend
 func LoadResponders() (map[string]*AutoResponse, error) {
 	responders := make(map[string]*AutoResponse)
 
-	err := db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(RespondersBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			s := &AutoResponse{}
-			err := json.Unmarshal(v, s)
-			if err == nil {
-				s.Init()
-				responders[s.Name] = s
-			}
+	err := store.ForEachResponder(func(name string, raw []byte) error {
+		s := &AutoResponse{}
+		err := json.Unmarshal(raw, s)
+		if err == nil {
+			s.Init()
+			responders[s.Name] = s
 		}
-
 		return nil
 	})
 
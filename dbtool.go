@@ -0,0 +1,508 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dbBuckets the buckets exported by `dumpr db export`, in import order
+var dbBuckets = []string{MetaBucket, RespondersBucket, BinsBucket, AuthBucket, SessionBucket}
+
+// resendBlobName matches the blob names of the resend results of a session
+var resendBlobName = regexp.MustCompile(`\.resend-([0-9]+)\.json$`)
+
+// DBReport result of validating the session entries of the storage backend against the session blobs
+type DBReport struct {
+	Sessions    int
+	Undecodable map[string]error
+	Missing     map[string][]string
+	Orphans     map[string][]string
+	sessions    map[string]*Session
+}
+
+// Problems returns the number of problems found
+func (r *DBReport) Problems() int {
+	return len(r.Undecodable) + len(r.Missing) + len(r.Orphans)
+}
+
+// dbExportLine a line of `dumpr db export`, either a record of a bucket or a session blob. Values that are not json are
+// written to data.
+type dbExportLine struct {
+	Bucket string          `json:"bucket,omitempty"`
+	Key    string          `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Blob   string          `json:"blob,omitempty"`
+	Data   []byte          `json:"data,omitempty"`
+}
+
+// runDBCommand implements `dumpr db check|repair|compact|export <file>|import <file>`. The commands work on the db in
+// --saveDir and must run while the server is stopped, sessions are not loaded so nothing is removed before the check.
+func runDBCommand(args []string) error {
+	usage := fmt.Errorf("usage: dumpr db check | repair | compact | export <file> [--blobs] | import <file>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "check" && len(args) == 1:
+		report, err := CheckDB()
+		if err != nil {
+			return err
+		}
+		printDBReport(report)
+		if report.Problems() > 0 {
+			return fmt.Errorf("%d problems found, fix them with: dumpr db repair", report.Problems())
+		}
+		return nil
+	case args[0] == "repair" && len(args) == 1:
+		report, err := CheckDB()
+		if err != nil {
+			return err
+		}
+		printDBReport(report)
+		return RepairDB(report)
+	case args[0] == "compact" && len(args) == 1:
+		before, after, err := store.Compact()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Compacted %s storage from %s to %s\n", store.Name(), ByteCountDecimal(before), ByteCountDecimal(after))
+		return nil
+	case args[0] == "export" && len(args) == 2:
+		return ExportDB(args[1], *exportBlobs)
+	case args[0] == "import" && len(args) == 2:
+		return ImportDB(args[1])
+	}
+	return usage
+}
+
+// CheckDB validates every session entry: it must decode and the blobs it references must exist. Blobs of sessions that
+// have no entry are reported as orphans.
+func CheckDB() (*DBReport, error) {
+	report := &DBReport{
+		Undecodable: make(map[string]error),
+		Missing:     make(map[string][]string),
+		Orphans:     make(map[string][]string),
+		sessions:    make(map[string]*Session),
+	}
+
+	err := store.ForEachSession(func(key string, raw []byte) error {
+		report.Sessions++
+		s := &Session{}
+		err := json.Unmarshal(raw, s)
+		if err != nil {
+			report.Undecodable[key] = err
+			return nil
+		}
+		report.sessions[key] = s
+
+		missing := make([]string, 0)
+		if !BlobExists(s.SaveFile) {
+			missing = append(missing, s.SaveFile)
+		}
+		// the frames file is created by the first recorded chunk, http request sessions never have one
+		if s.FramesFile != "" && s.BytesIn+s.BytesOut > 0 && !BlobExists(s.FramesFile) {
+			missing = append(missing, s.FramesFile)
+		}
+		for _, f := range s.MultiPartFiles {
+			if !BlobExists(f.File) {
+				missing = append(missing, f.File)
+			}
+		}
+		for _, r := range s.Resends {
+			if !BlobExists(r.File) {
+				missing = append(missing, r.File)
+			}
+		}
+		if len(missing) > 0 {
+			report.Missing[key] = missing
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, s := range report.sessions {
+		known[s.Key] = true
+	}
+
+	err = store.Blobs().List(func(name string, size int64) error {
+		key := blobSessionKey(name)
+		if !known[key] {
+			report.Orphans[key] = append(report.Orphans[key], name)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// RepairDB fixes the problems of a report. Undecodable entries and entries without a raw capture are deleted, missing
+// frames, uploads and resends are dropped from the entry, entries are rebuilt for orphaned raw captures and other orphaned
+// blobs are removed.
+func RepairDB(report *DBReport) error {
+	blobs := store.Blobs()
+	deleted, updated, rebuilt, removed := 0, 0, 0, 0
+
+	for key := range report.Undecodable {
+		err := store.DeleteSession(key)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+
+	for key, missing := range report.Missing {
+		s := report.sessions[key]
+		if !BlobExists(s.SaveFile) {
+			for _, name := range sessionBlobs(s) {
+				if blobs.Remove(name) == nil {
+					removed++
+				}
+			}
+			err := store.DeleteSession(key)
+			if err != nil {
+				return err
+			}
+			deleted++
+			continue
+		}
+
+		gone := make(map[string]bool)
+		for _, name := range missing {
+			gone[name] = true
+		}
+		if gone[s.FramesFile] {
+			s.FramesFile = ""
+		}
+		for k, f := range s.MultiPartFiles {
+			if gone[f.File] {
+				delete(s.MultiPartFiles, k)
+			}
+		}
+		resends := make([]*ResendResult, 0, len(s.Resends))
+		for _, r := range s.Resends {
+			if !gone[r.File] {
+				resends = append(resends, r)
+			}
+		}
+		s.Resends = resends
+
+		err := store.PutSession(key, s.Bytes())
+		if err != nil {
+			return err
+		}
+		updated++
+	}
+
+	for key, names := range report.Orphans {
+		s, err := rebuildSession(key, names)
+		if err == nil {
+			err = store.PutSession(s.Key, s.Bytes())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Rebuilt session %s from %d blobs\n", key, len(names))
+			rebuilt++
+			continue
+		}
+
+		fmt.Printf("Removing orphaned blobs of %s: %v\n", key, err)
+		for _, name := range names {
+			if blobs.Remove(name) == nil {
+				removed++
+			}
+		}
+	}
+
+	fmt.Printf("Repaired db, deleted: %d updated: %d rebuilt: %d removed blobs: %d\n", deleted, updated, rebuilt, removed)
+	return nil
+}
+
+// rebuildSession recreates the entry of a session from its blobs, the start time is taken from the session key. The
+// bin and forwarding details of the session are lost.
+func rebuildSession(key string, names []string) (*Session, error) {
+	values, err := hasher.DecodeInt64WithError(key)
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("%s is not a session key", key)
+	}
+
+	s := &Session{
+		Key:            key,
+		StartTime:      time.Unix(values[0], 0),
+		Protocol:       TCP,
+		MultiPartFiles: make(map[string]*MultiPartFile),
+	}
+	s.EndTime = s.StartTime
+
+	resends := make(map[int]*ResendResult)
+	for _, name := range names {
+		size, _ := store.Blobs().Size(name)
+		switch {
+		case strings.HasSuffix(filepath.Dir(name), ".files"):
+			s.MultiPartFiles[filepath.Base(name)] = &MultiPartFile{File: name, Size: size, HumanSize: ByteCountDecimal(size)}
+		case strings.HasSuffix(name, ".raw"):
+			s.SaveFile = name
+		case strings.HasSuffix(name, ".frames"):
+			s.FramesFile = name
+		case resendBlobName.MatchString(name):
+			index, _ := strconv.Atoi(resendBlobName.FindStringSubmatch(name)[1])
+			raw, err := ReadBlob(name)
+			if err != nil {
+				continue
+			}
+			r := &ResendResult{}
+			if json.Unmarshal(raw, r) == nil {
+				r.File = name
+				r.Response = nil
+				resends[index] = r
+			}
+		}
+	}
+
+	if s.SaveFile == "" {
+		return nil, fmt.Errorf("no raw capture")
+	}
+
+	indexes := make([]int, 0, len(resends))
+	for i := range resends {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.Resends = append(s.Resends, resends[i])
+	}
+
+	raw, err := ReadBlob(s.SaveFile)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &HTTPRequestJSON{}
+	if json.Unmarshal(raw, request) == nil && request.Method != "" {
+		s.Protocol = HTTP
+		s.HTTPMethod = request.Method
+		s.HTTPPath = request.RequestURI
+		s.Redacted = request.Redacted
+		return s, nil
+	}
+
+	s.BytesIn = int64(len(raw))
+	if s.FramesFile != "" {
+		frames, err := ReadFrames(s.FramesFile, false)
+		if err == nil {
+			s.BytesIn = 0
+			for _, f := range frames {
+				if f.Direction == Inbound {
+					s.BytesIn += int64(f.Size)
+				} else {
+					s.BytesOut += int64(f.Size)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// blobSessionKey returns the key of the session a blob belongs to, <key>.raw, <key>.frames, <key>.resend-N.json or
+// <key>.files/<name>
+func blobSessionKey(name string) string {
+	base := filepath.Base(name)
+	if dir := filepath.Base(filepath.Dir(name)); strings.HasSuffix(dir, ".files") {
+		base = dir
+	}
+	if i := strings.Index(base, "."); i != -1 {
+		base = base[:i]
+	}
+	return base
+}
+
+// sessionBlobs returns the names of the blobs referenced by a session
+func sessionBlobs(s *Session) []string {
+	names := []string{s.SaveFile}
+	if s.FramesFile != "" {
+		names = append(names, s.FramesFile)
+	}
+	for _, f := range s.MultiPartFiles {
+		names = append(names, f.File)
+	}
+	for _, r := range s.Resends {
+		names = append(names, r.File)
+	}
+	return names
+}
+
+func printDBReport(report *DBReport) {
+	fmt.Printf("Checked %d sessions of %s storage, %d problems found\n", report.Sessions, store.Name(), report.Problems())
+
+	undecodable := make([]string, 0, len(report.Undecodable))
+	for key := range report.Undecodable {
+		undecodable = append(undecodable, key)
+	}
+	sort.Strings(undecodable)
+	for _, key := range undecodable {
+		fmt.Printf("  %s undecodable entry: %v\n", key, report.Undecodable[key])
+	}
+	for _, key := range sortedKeys(report.Missing) {
+		for _, name := range report.Missing[key] {
+			fmt.Printf("  %s missing %s\n", key, name)
+		}
+	}
+	for _, key := range sortedKeys(report.Orphans) {
+		for _, name := range report.Orphans[key] {
+			fmt.Printf("  %s orphaned %s\n", key, name)
+		}
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ExportDB writes every record of the storage backend to file as json lines, the session blobs are included if
+// withBlobs is set.
+func ExportDB(file string, withBlobs bool) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	records, blobCount := 0, 0
+	for _, bucket := range dbBuckets {
+		err = forEachInBucket(bucket, func(key string, raw []byte) error {
+			line := &dbExportLine{Bucket: bucket, Key: key}
+			if json.Valid(raw) {
+				line.Value = raw
+			} else {
+				line.Data = raw
+			}
+			records++
+			return encoder.Encode(line)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if withBlobs {
+		err = store.Blobs().List(func(name string, size int64) error {
+			data, err := ReadBlob(name)
+			if err != nil {
+				return err
+			}
+			blobCount++
+			return encoder.Encode(&dbExportLine{Blob: name, Data: data})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d records and %d blobs from %s storage to %s\n", records, blobCount, store.Name(), file)
+	return f.Close()
+}
+
+// ImportDB reads a file written by ExportDB into the storage backend, existing records are replaced and existing blobs
+// are kept.
+func ImportDB(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	records, blobCount, skipped := 0, 0, 0
+	// a stream decoder, the lines of blobs exported with --blobs have no size limit
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for n := 1; ; n++ {
+		line := &dbExportLine{}
+		err = decoder.Decode(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s entry %d: %v", file, n, err)
+		}
+
+		switch {
+		case line.Blob != "":
+			if BlobExists(line.Blob) {
+				skipped++
+				continue
+			}
+			err = WriteBlob(line.Blob, line.Data)
+			blobCount++
+		case line.Bucket != "" && line.Key != "":
+			raw := []byte(line.Value)
+			if line.Value == nil {
+				raw = line.Data
+			}
+			err = putInBucket(line.Bucket, line.Key, raw)
+			records++
+		default:
+			err = fmt.Errorf("neither a record nor a blob")
+		}
+		if err != nil {
+			return fmt.Errorf("%s entry %d: %v", file, n, err)
+		}
+	}
+
+	fmt.Printf("Imported %d records and %d blobs into %s storage from %s, %d existing blobs kept\n", records, blobCount, store.Name(), file, skipped)
+	return nil
+}
+
+func forEachInBucket(bucket string, fn func(key string, raw []byte) error) error {
+	switch bucket {
+	case SessionBucket:
+		return store.ForEachSession(fn)
+	case RespondersBucket:
+		return store.ForEachResponder(fn)
+	}
+	return store.ForEachRecord(bucket, fn)
+}
+
+func putInBucket(bucket, key string, raw []byte) error {
+	switch bucket {
+	case SessionBucket:
+		return store.PutSession(key, raw)
+	case RespondersBucket:
+		return store.PutResponder(key, raw)
+	}
+
+	for _, b := range dbBuckets {
+		if b == bucket {
+			return store.PutRecord(bucket, key, raw)
+		}
+	}
+	return fmt.Errorf("unknown bucket %s", bucket)
+}
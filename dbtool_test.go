@@ -0,0 +1,60 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairMissingFramesKeepsUpstream(t *testing.T) {
+	setupTestServer(t)
+
+	s := &Session{
+		Key:        "forwarded",
+		SaveFile:   filepath.Join(*saveDir, "20210101", "forwarded.raw"),
+		FramesFile: filepath.Join(*saveDir, "20210101", "forwarded.frames"),
+		Upstream:   "127.0.0.1:9000",
+		BytesIn:    5,
+	}
+	err := WriteBlob(s.SaveFile, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = StoreSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := report.Missing[s.Key]; len(missing) != 1 || missing[0] != s.FramesFile {
+		t.Fatalf("missing = %v, want the frames file", missing)
+	}
+
+	err = RepairDB(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := store.GetSession(s.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired := &Session{}
+	err = json.Unmarshal(raw, repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired.FramesFile != "" {
+		t.Errorf("frames file = %q, want it cleared", repaired.FramesFile)
+	}
+	if repaired.Upstream != s.Upstream {
+		t.Errorf("upstream = %q, want %q", repaired.Upstream, s.Upstream)
+	}
+}
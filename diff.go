@@ -0,0 +1,352 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxDiffBytes bytes of a body or a tcp capture that are compared, the rest is ignored
+	maxDiffBytes = 1 << 20
+
+	// maxDiffLines lines of each side that are compared by the line diff
+	maxDiffLines = 2000
+)
+
+// DiffChange a field that differs between two sessions. Op is added or removed when the field is only in b or only in
+// a, changed when both have different values.
+type DiffChange struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	A     interface{} `json:"a,omitempty"`
+	B     interface{} `json:"b,omitempty"`
+}
+
+// DiffLine a line of a line diff, Op is " " for a line in both, "-" for a line only in a and "+" for a line only in b
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// SessionDiff differences between two sessions of the same protocol. Http sessions are compared field by field, json
+// bodies structurally, other bodies and tcp captures line by line as text or as a hex dump.
+type SessionDiff struct {
+	A         *ApiSession   `json:"a"`
+	B         *ApiSession   `json:"b"`
+	Protocol  string        `json:"protocol"`
+	Equal     bool          `json:"equal"`
+	Changes   []*DiffChange `json:"changes"`
+	Mode      string        `json:"mode,omitempty"`
+	Lines     []*DiffLine   `json:"lines,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// DiffSessions compares the captures of two sessions
+func DiffSessions(a, b *Session) (*SessionDiff, error) {
+	if a.Protocol != b.Protocol {
+		return nil, fmt.Errorf("sessions %s and %s have different protocols, %s and %s", a.Key, b.Key, a.Protocol, b.Protocol)
+	}
+
+	d := &SessionDiff{
+		A:        a.ToApiSession(),
+		B:        b.ToApiSession(),
+		Protocol: a.Protocol.String(),
+		Changes:  make([]*DiffChange, 0),
+	}
+
+	if a.Protocol == HTTP {
+		if a.HTTPSession == nil || b.HTTPSession == nil {
+			return nil, fmt.Errorf("http request of %s or %s is not available", a.Key, b.Key)
+		}
+		d.diffHTTP(a.HTTPSession, b.HTTPSession)
+	} else {
+		err := d.diffTCP(a, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.Equal = len(d.Changes) == 0 && !hasLineChanges(d.Lines)
+	return d, nil
+}
+
+func (d *SessionDiff) diffHTTP(a, b *HTTPRequestJSON) {
+	d.diffValue("method", a.Method, b.Method)
+
+	pathA, queryA := splitRequestURI(a.RequestURI)
+	pathB, queryB := splitRequestURI(b.RequestURI)
+	d.diffValue("path", pathA, pathB)
+	d.diffValues("query", queryA, queryB)
+	d.diffValues("header", a.Header, b.Header)
+	d.diffValues("form", a.PostForm, b.PostForm)
+
+	bodyA := d.truncate(a.Body)
+	bodyB := d.truncate(b.Body)
+	if bytes.Equal(bodyA, bodyB) {
+		return
+	}
+
+	jsonA, okA := decodeJSONBody(bodyA)
+	jsonB, okB := decodeJSONBody(bodyB)
+	if okA && okB {
+		d.diffJSON("body", jsonA, jsonB)
+		return
+	}
+	d.diffPayload(bodyA, bodyB)
+}
+
+func (d *SessionDiff) diffTCP(a, b *Session) error {
+	a.mu.RLock()
+	inA, outA := a.BytesIn, a.BytesOut
+	a.mu.RUnlock()
+	b.mu.RLock()
+	inB, outB := b.BytesIn, b.BytesOut
+	b.mu.RUnlock()
+	d.diffValue("bytesIn", inA, inB)
+	d.diffValue("bytesOut", outA, outB)
+
+	payloadA, err := ReadBlob(a.SaveFile)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", a.Key, err)
+	}
+	payloadB, err := ReadBlob(b.SaveFile)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", b.Key, err)
+	}
+	d.diffPayload(d.truncate(payloadA), d.truncate(payloadB))
+	return nil
+}
+
+func (d *SessionDiff) diffValue(field string, a, b interface{}) {
+	if a != b {
+		d.Changes = append(d.Changes, &DiffChange{Field: field, Op: "changed", A: a, B: b})
+	}
+}
+
+// diffValues compares multi valued maps, headers, query strings and forms, by name
+func (d *SessionDiff) diffValues(field string, a, b map[string][]string) {
+	for _, name := range unionKeys(a, b) {
+		valuesA, okA := a[name]
+		valuesB, okB := b[name]
+		switch {
+		case !okB:
+			d.Changes = append(d.Changes, &DiffChange{Field: field + "." + name, Op: "removed", A: strings.Join(valuesA, ", ")})
+		case !okA:
+			d.Changes = append(d.Changes, &DiffChange{Field: field + "." + name, Op: "added", B: strings.Join(valuesB, ", ")})
+		case strings.Join(valuesA, "\x00") != strings.Join(valuesB, "\x00"):
+			d.Changes = append(d.Changes, &DiffChange{Field: field + "." + name, Op: "changed", A: strings.Join(valuesA, ", "), B: strings.Join(valuesB, ", ")})
+		}
+	}
+}
+
+// diffJSON compares decoded json values, objects by key and arrays by index
+func (d *SessionDiff) diffJSON(path string, a, b interface{}) {
+	objectA, okA := a.(map[string]interface{})
+	objectB, okB := b.(map[string]interface{})
+	if okA && okB {
+		keys := make([]string, 0, len(objectA)+len(objectB))
+		for k := range objectA {
+			keys = append(keys, k)
+		}
+		for k := range objectB {
+			if _, ok := objectA[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			valueA, inA := objectA[k]
+			valueB, inB := objectB[k]
+			switch {
+			case !inB:
+				d.Changes = append(d.Changes, &DiffChange{Field: path + "." + k, Op: "removed", A: valueA})
+			case !inA:
+				d.Changes = append(d.Changes, &DiffChange{Field: path + "." + k, Op: "added", B: valueB})
+			default:
+				d.diffJSON(path+"."+k, valueA, valueB)
+			}
+		}
+		return
+	}
+
+	arrayA, okA := a.([]interface{})
+	arrayB, okB := b.([]interface{})
+	if okA && okB {
+		for i := 0; i < len(arrayA) || i < len(arrayB); i++ {
+			field := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(arrayB):
+				d.Changes = append(d.Changes, &DiffChange{Field: field, Op: "removed", A: arrayA[i]})
+			case i >= len(arrayA):
+				d.Changes = append(d.Changes, &DiffChange{Field: field, Op: "added", B: arrayB[i]})
+			default:
+				d.diffJSON(field, arrayA[i], arrayB[i])
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		d.Changes = append(d.Changes, &DiffChange{Field: path, Op: "changed", A: a, B: b})
+	}
+}
+
+// diffPayload line diffs two payloads, as text when both are printable utf8 else as hex dumps
+func (d *SessionDiff) diffPayload(a, b []byte) {
+	var linesA, linesB []string
+	if isText(a) && isText(b) {
+		d.Mode = "text"
+		linesA = splitLines(string(a))
+		linesB = splitLines(string(b))
+	} else {
+		d.Mode = "hex"
+		linesA = splitLines(hex.Dump(a))
+		linesB = splitLines(hex.Dump(b))
+	}
+
+	if len(linesA) > maxDiffLines {
+		linesA = linesA[:maxDiffLines]
+		d.Truncated = true
+	}
+	if len(linesB) > maxDiffLines {
+		linesB = linesB[:maxDiffLines]
+		d.Truncated = true
+	}
+	d.Lines = diffLines(linesA, linesB)
+}
+
+// diffLines returns the line diff of a and b based on their longest common subsequence
+func diffLines(a, b []string) []*DiffLine {
+	// lcs[i][j] length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]*DiffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, &DiffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, &DiffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			lines = append(lines, &DiffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, &DiffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, &DiffLine{Op: "+", Text: b[j]})
+	}
+	return lines
+}
+
+// isText returns true for utf8 without control characters other than line breaks and tabs
+func isText(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func hasLineChanges(lines []*DiffLine) bool {
+	for _, l := range lines {
+		if l.Op != " " {
+			return true
+		}
+	}
+	return false
+}
+
+func splitRequestURI(requestURI string) (string, map[string][]string) {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return requestURI, map[string][]string{}
+	}
+	return u.Path, u.Query()
+}
+
+// decodeJSONBody decodes a body holding a single json value, numbers are kept as json.Number so they are compared and
+// encoded again exactly as they were sent
+func decodeJSONBody(body []byte) (interface{}, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return v, true
+}
+
+func unionKeys(a, b map[string][]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// truncate returns the first maxDiffBytes of b
+func (d *SessionDiff) truncate(b []byte) []byte {
+	if len(b) > maxDiffBytes {
+		d.Truncated = true
+		return b[:maxDiffBytes]
+	}
+	return b
+}
@@ -0,0 +1,461 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR structs for the HTTP Archive 1.2 format, http://www.softwareishard.com/blog/har-12-spec/
+type (
+	// HAR root of a HTTP Archive document
+	HAR struct {
+		Log *HARLog `json:"log"`
+	}
+
+	// HARLog log of a HTTP Archive document
+	HARLog struct {
+		Version string      `json:"version"`
+		Creator *HARCreator `json:"creator"`
+		Entries []*HAREntry `json:"entries"`
+	}
+
+	// HARCreator application that created the HTTP Archive
+	HARCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	// HAREntry single request and response
+	HAREntry struct {
+		StartedDateTime string       `json:"startedDateTime"`
+		Time            float64      `json:"time"`
+		Request         *HARRequest  `json:"request"`
+		Response        *HARResponse `json:"response"`
+		Cache           struct{}     `json:"cache"`
+		Timings         *HARTimings  `json:"timings"`
+		ServerIPAddress string       `json:"serverIPAddress,omitempty"`
+		Comment         string       `json:"comment,omitempty"`
+	}
+
+	// HARRequest request of a HAREntry
+	HARRequest struct {
+		Method      string          `json:"method"`
+		URL         string          `json:"url"`
+		HTTPVersion string          `json:"httpVersion"`
+		Cookies     []*HARNameValue `json:"cookies"`
+		Headers     []*HARNameValue `json:"headers"`
+		QueryString []*HARNameValue `json:"queryString"`
+		PostData    *HARPostData    `json:"postData,omitempty"`
+		HeadersSize int             `json:"headersSize"`
+		BodySize    int             `json:"bodySize"`
+	}
+
+	// HARResponse response of a HAREntry
+	HARResponse struct {
+		Status      int             `json:"status"`
+		StatusText  string          `json:"statusText"`
+		HTTPVersion string          `json:"httpVersion"`
+		Cookies     []*HARNameValue `json:"cookies"`
+		Headers     []*HARNameValue `json:"headers"`
+		Content     *HARContent     `json:"content"`
+		RedirectURL string          `json:"redirectURL"`
+		HeadersSize int             `json:"headersSize"`
+		BodySize    int             `json:"bodySize"`
+	}
+
+	// HARNameValue name value pair used for headers, cookies, query string and params
+	HARNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	// HARPostData body of a HARRequest, a body that is not utf8 is base64 encoded like HARContent
+	HARPostData struct {
+		MimeType string          `json:"mimeType"`
+		Params   []*HARNameValue `json:"params"`
+		Text     string          `json:"text"`
+		Encoding string          `json:"encoding,omitempty"`
+	}
+
+	// HARContent body of a HARResponse
+	HARContent struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+
+	// HARTimings timings of a HAREntry
+	HARTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// RequestURL returns the absolute url of the captured request of a http session
+func (s *Session) RequestURL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.requestURLLocked()
+}
+
+// requestURLLocked returns the absolute url of the captured request, a request sent to a proxy already has it as its
+// request uri. s.mu must be held.
+func (s *Session) requestURLLocked() string {
+	request := s.HTTPSession
+	scheme := "http"
+	if s.TLS != nil {
+		scheme = "https"
+	}
+
+	if request.Method == http.MethodConnect {
+		// authority form, the request uri is the host:port to connect to
+		return fmt.Sprintf("%s://%s", scheme, request.RequestURI)
+	}
+	if u, err := url.ParseRequestURI(request.RequestURI); err == nil && u.IsAbs() {
+		return u.String()
+	}
+
+	host := request.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, request.RequestURI)
+}
+
+// CurlCommand returns a curl command line that sends the captured request of a http session
+func (s *Session) CurlCommand() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	request := s.HTTPSession
+
+	var sb strings.Builder
+	sb.WriteString("curl")
+	if request.Method != http.MethodGet || len(request.Body) > 0 {
+		sb.WriteString(" -X ")
+		sb.WriteString(shellQuote([]byte(request.Method)))
+	}
+	sb.WriteString(" ")
+	sb.WriteString(shellQuote([]byte(s.requestURLLocked())))
+
+	for _, name := range sortedHeaderNames(request.Header) {
+		if isHopHeader(name) || strings.EqualFold(name, "Host") {
+			continue
+		}
+		for _, v := range request.Header[name] {
+			sb.WriteString(" \\\n  -H ")
+			sb.WriteString(shellQuote([]byte(fmt.Sprintf("%s: %s", name, v))))
+		}
+	}
+
+	if len(request.Body) > 0 {
+		sb.WriteString(" \\\n  --data-binary ")
+		sb.WriteString(shellQuote(request.Body))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// RawRequest returns the captured request of a http session in wire format. The body is sent with a Content-Length
+// as it is stored decoded.
+func (s *Session) RawRequest() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	request := s.HTTPSession
+
+	var b bytes.Buffer
+	proto := request.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	b.WriteString(fmt.Sprintf("%s %s %s\r\n", request.Method, request.RequestURI, proto))
+	if request.Host != "" {
+		b.WriteString(fmt.Sprintf("Host: %s\r\n", request.Host))
+	}
+
+	for _, name := range sortedHeaderNames(request.Header) {
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			continue
+		}
+		for _, v := range request.Header[name] {
+			b.WriteString(fmt.Sprintf("%s: %s\r\n", name, v))
+		}
+	}
+
+	if len(request.Body) > 0 || http.Header(request.Header).Get("Content-Length") != "" {
+		b.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(request.Body)))
+	}
+	b.WriteString("\r\n")
+	b.Write(request.Body)
+	return b.Bytes()
+}
+
+// HAREntry returns the HTTP Archive entry of a http session, nil if the session has no captured request
+func (s *Session) HAREntry() *HAREntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	request := s.HTTPSession
+	if request == nil {
+		return nil
+	}
+
+	harRequest := &HARRequest{
+		Method:      request.Method,
+		URL:         s.requestURLLocked(),
+		HTTPVersion: request.Proto,
+		Cookies:     harCookies(request.Header),
+		Headers:     harHeaders(request.Header),
+		QueryString: make([]*HARNameValue, 0),
+		HeadersSize: -1,
+		BodySize:    len(request.Body),
+	}
+
+	u, err := url.ParseRequestURI(request.RequestURI)
+	if err == nil {
+		harRequest.QueryString = harValues(u.Query())
+	}
+
+	if len(request.Body) > 0 {
+		harRequest.PostData = &HARPostData{
+			MimeType: http.Header(request.Header).Get("Content-Type"),
+			Params:   harValues(request.PostForm),
+		}
+		harRequest.PostData.Text, harRequest.PostData.Encoding = harText(request.Body)
+	}
+
+	harResponse := &HARResponse{
+		Cookies:     make([]*HARNameValue, 0),
+		Headers:     make([]*HARNameValue, 0),
+		Content:     &HARContent{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+
+	if response := s.HTTPResponse; response != nil {
+		header := http.Header(response.Header)
+		harResponse.Status = response.StatusCode
+		harResponse.StatusText = http.StatusText(response.StatusCode)
+		harResponse.HTTPVersion = response.Proto
+		harResponse.Headers = harHeaders(response.Header)
+		harResponse.RedirectURL = header.Get("Location")
+		harResponse.BodySize = len(response.Body)
+		harResponse.Content = &HARContent{
+			Size:     len(response.Body),
+			MimeType: header.Get("Content-Type"),
+		}
+		harResponse.Content.Text, harResponse.Content.Encoding = harText(response.Body)
+	}
+
+	entry := &HAREntry{
+		StartedDateTime: s.StartTime.Format(time.RFC3339Nano),
+		Time:            float64(s.EndTime.Sub(s.StartTime).Microseconds()) / 1000,
+		Request:         harRequest,
+		Response:        harResponse,
+		Timings:         &HARTimings{Send: 0, Wait: 0, Receive: 0},
+		Comment:         fmt.Sprintf("dumpr! session %s", s.Key),
+	}
+	if entry.Time < 0 {
+		entry.Time = 0
+	}
+	entry.Timings.Wait = entry.Time
+	return entry
+}
+
+// ExportFilter returns the http sessions matching the query values keys (comma separated session keys), ip,
+// method, bin, path (regular expression), since and until (RFC3339 time or duration before now).
+func ExportFilter(query url.Values) ([]*Session, error) {
+	keys := make(map[string]bool)
+	for _, v := range query["keys"] {
+		for _, k := range strings.Split(v, ",") {
+			if k != "" {
+				keys[k] = true
+			}
+		}
+	}
+
+	var pathRegex *regexp.Regexp
+	if query.Get("path") != "" {
+		var err error
+		pathRegex, err = regexp.Compile(query.Get("path"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path: %v", err)
+		}
+	}
+
+	since, err := parseTimeParam(query.Get("since"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid since: %v", err)
+	}
+	until, err := parseTimeParam(query.Get("until"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid until: %v", err)
+	}
+
+	ip := query.Get("ip")
+	method := query.Get("method")
+	bin := strings.ToLower(query.Get("bin"))
+	return Sessions.Filter(func(s *Session) bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		switch {
+		case s.Protocol != HTTP || s.HTTPSession == nil:
+			return false
+		case len(keys) > 0 && !keys[s.Key]:
+			return false
+		case ip != "" && s.IP != ip:
+			return false
+		case bin != "" && s.Bin != bin:
+			return false
+		case method != "" && !strings.EqualFold(s.HTTPMethod, method):
+			return false
+		case pathRegex != nil && !pathRegex.MatchString(s.HTTPPath):
+			return false
+		case !since.IsZero() && s.StartTime.Before(since):
+			return false
+		case !until.IsZero() && s.StartTime.After(until):
+			return false
+		}
+		return true
+	}), nil
+}
+
+// parseTimeParam parses a RFC3339 time or a duration before now, an empty value returns the zero time
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// NewHAR returns a HTTP Archive document for the http sessions
+func NewHAR(sessions []*Session) *HAR {
+	har := &HAR{Log: &HARLog{
+		Version: "1.2",
+		Creator: &HARCreator{Name: "dumpr!", Version: Version},
+		Entries: make([]*HAREntry, 0, len(sessions)),
+	}}
+
+	for _, s := range sessions {
+		if s.ProtocolType() != HTTP {
+			continue
+		}
+		if entry := s.HAREntry(); entry != nil {
+			har.Log.Entries = append(har.Log.Entries, entry)
+		}
+	}
+	return har
+}
+
+// harText returns the text of a HAR body and its encoding, a body that is not valid utf8 is base64 encoded
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(header map[string][]string) []*HARNameValue {
+	list := make([]*HARNameValue, 0, len(header))
+	for _, name := range sortedHeaderNames(header) {
+		for _, v := range header[name] {
+			list = append(list, &HARNameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+func harCookies(header map[string][]string) []*HARNameValue {
+	list := make([]*HARNameValue, 0)
+	req := &http.Request{Header: header}
+	for _, c := range req.Cookies() {
+		list = append(list, &HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	return list
+}
+
+func harValues(values map[string][]string) []*HARNameValue {
+	list := make([]*HARNameValue, 0, len(values))
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range values[name] {
+			list = append(list, &HARNameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+func sortedHeaderNames(header map[string][]string) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isHopHeader(name string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellQuote quotes the value for a posix shell, values that are not printable utf8 use $'...' quoting
+func shellQuote(value []byte) string {
+	printable := utf8.Valid(value)
+	if printable {
+		for _, r := range string(value) {
+			if r < 0x20 && r != '\n' && r != '\t' || r == 0x7f {
+				printable = false
+				break
+			}
+		}
+	}
+
+	if printable {
+		return "'" + strings.ReplaceAll(string(value), "'", `'\''`) + "'"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("$'")
+	for _, c := range value {
+		switch {
+		case c == '\'' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		default:
+			sb.WriteString(`\x`)
+			sb.WriteString(strconv.FormatInt(int64(c)|0x100, 16)[1:])
+		}
+	}
+	sb.WriteString("'")
+	return sb.String()
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestRequestURLAbsoluteForm(t *testing.T) {
+	for _, tc := range []struct {
+		method, host, uri, want string
+	}{
+		{http.MethodGet, "example.com", "/a?b=c", "http://example.com/a?b=c"},
+		{http.MethodGet, "dumpr.local", "http://example.com/a?b=c", "http://example.com/a?b=c"},
+		{http.MethodConnect, "example.com:443", "example.com:443", "http://example.com:443"},
+	} {
+		s := &Session{HTTPSession: &HTTPRequestJSON{Method: tc.method, Host: tc.host, RequestURI: tc.uri}}
+		if got := s.RequestURL(); got != tc.want {
+			t.Errorf("%s %s = %q, want %q", tc.method, tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestHAREntryBinaryBody(t *testing.T) {
+	body := []byte{0xff, 0xfe, 0x00, 'a'}
+	s := &Session{
+		Protocol:     HTTP,
+		HTTPSession:  &HTTPRequestJSON{Method: http.MethodPost, Host: "example.com", RequestURI: "/upload", Body: body},
+		HTTPResponse: &HTTPResponseJSON{StatusCode: 200, Body: []byte("ok")},
+	}
+
+	entry := s.HAREntry()
+	postData := entry.Request.PostData
+	if postData.Encoding != "base64" || postData.Text != base64.StdEncoding.EncodeToString(body) {
+		t.Errorf("postData = %q encoding %q, want base64", postData.Text, postData.Encoding)
+	}
+	if content := entry.Response.Content; content.Encoding != "" || content.Text != "ok" {
+		t.Errorf("content = %q encoding %q, want the text", content.Text, content.Encoding)
+	}
+}
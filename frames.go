@@ -0,0 +1,151 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// framesMagic header written at the start of every frames file, followed by the session start time in unix nanoseconds.
+//
+// Each record that follows is laid out as
+//
+//	elapsed   int64  nanoseconds since the session start, taken from the monotonic clock
+//	direction uint8  Direction of the chunk
+//	size      uint32 length of the payload
+//	payload   []byte
+const framesMagic = "DUMPRFR1"
+
+const frameHeaderSize = 8 + 1 + 4
+
+// maxFrameSize upper bound of a single frame payload accepted when reading a frames file
+const maxFrameSize = 64 << 20
+
+// Frame struct to store a chunk of recorded traffic with the time and direction it was seen
+type Frame struct {
+	Time      time.Time     `json:"time"`
+	Elapsed   time.Duration `json:"elapsedNs"`
+	Direction Direction     `json:"direction"`
+	Offset    int64         `json:"offset"`
+	Size      int           `json:"size"`
+	Data      []byte        `json:"data,omitempty"`
+}
+
+// FrameWriter appends frames to a frames blob
+type FrameWriter struct {
+	f     io.WriteCloser
+	start time.Time
+}
+
+// NewFrameWriter creates the frames blob and writes the header
+func NewFrameWriter(file string, start time.Time) (*FrameWriter, error) {
+	f, err := store.Blobs().Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(framesMagic)+8)
+	copy(header, framesMagic)
+	binary.BigEndian.PutUint64(header[len(framesMagic):], uint64(start.UnixNano()))
+	_, err = f.Write(header)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &FrameWriter{f: f, start: start}, nil
+}
+
+// Write appends a frame for the payload
+func (w *FrameWriter) Write(now time.Time, dir Direction, pay []byte) error {
+	record := make([]byte, frameHeaderSize+len(pay))
+	binary.BigEndian.PutUint64(record[0:8], uint64(now.Sub(w.start)))
+	record[8] = byte(dir)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(pay)))
+	copy(record[frameHeaderSize:], pay)
+	_, err := w.f.Write(record)
+	return err
+}
+
+// Close closes the frames file
+func (w *FrameWriter) Close() error {
+	return w.f.Close()
+}
+
+// ReadFrames reads all frames from a frames file, the payloads are only kept if withData is set
+func ReadFrames(file string, withData bool) ([]*Frame, error) {
+	frames := make([]*Frame, 0)
+	err := WalkFrames(file, func(frame *Frame) error {
+		if !withData {
+			frame.Data = nil
+		}
+		frames = append(frames, frame)
+		return nil
+	})
+	return frames, err
+}
+
+// WalkFrames calls fn for every frame of a frames file in the order they were recorded
+func WalkFrames(file string, fn func(frame *Frame) error) error {
+	f, err := store.Blobs().Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(framesMagic)+8)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return fmt.Errorf("%s invalid frames header: %v", file, err)
+	}
+	if string(header[:len(framesMagic)]) != framesMagic {
+		return fmt.Errorf("%s is not a frames file", file)
+	}
+	start := time.Unix(0, int64(binary.BigEndian.Uint64(header[len(framesMagic):])))
+
+	var offset int64
+	record := make([]byte, frameHeaderSize)
+	for {
+		_, err = io.ReadFull(r, record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s truncated frame at offset %d: %v", file, offset, err)
+		}
+
+		size := binary.BigEndian.Uint32(record[9:13])
+		if size > maxFrameSize {
+			return fmt.Errorf("%s invalid frame size %d at offset %d", file, size, offset)
+		}
+
+		elapsed := time.Duration(binary.BigEndian.Uint64(record[0:8]))
+		frame := &Frame{
+			Time:      start.Add(elapsed),
+			Elapsed:   elapsed,
+			Direction: Direction(record[8]),
+			Offset:    offset,
+			Size:      int(size),
+			Data:      make([]byte, size),
+		}
+
+		_, err = io.ReadFull(r, frame.Data)
+		if err != nil {
+			return fmt.Errorf("%s truncated frame at offset %d: %v", file, offset, err)
+		}
+		offset += int64(size)
+
+		err = fn(frame)
+		if err != nil {
+			return err
+		}
+	}
+}
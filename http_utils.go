@@ -36,9 +36,11 @@ type HTTPRequestJSON struct {
 	PostForm         map[string][]string `json:"PostForm"`
 	MultipartForm    *multipart.Form     `json:"MultipartForm"`
 	Body             []byte              `json:"Body"`
+	Redacted         []string            `json:"Redacted,omitempty"`
 }
 
-// NewHTTPRequestJSON copy a http request to struct for storing http request details
+// NewHTTPRequestJSON copy a http request to struct for storing http request details, the redaction rules are applied
+// to the copy.
 func NewHTTPRequestJSON(r *http.Request) *HTTPRequestJSON {
 
 	bodyBytes, err := ioutil.ReadAll(r.Body)
@@ -67,10 +69,76 @@ func NewHTTPRequestJSON(r *http.Request) *HTTPRequestJSON {
 		Body:             bodyBytes,
 	}
 
+	redactor.RedactRequest(request)
 	return request
 
 }
 
+// HTTPResponseJSON struct for storing http response details
+type HTTPResponseJSON struct {
+	Time          string              `json:"Time"`
+	Status        string              `json:"Status"`
+	StatusCode    int                 `json:"StatusCode"`
+	Proto         string              `json:"Proto"`
+	ContentLength int64               `json:"ContentLength"`
+	Header        map[string][]string `json:"Header"`
+	Body          []byte              `json:"Body"`
+}
+
+// NewHTTPResponseJSON copy a http response and the body read from it to struct for storing http response details
+func NewHTTPResponseJSON(r *http.Response, body []byte) *HTTPResponseJSON {
+	return &HTTPResponseJSON{
+		Time:          time.Now().UTC().Format(JavascriptISOString),
+		Status:        r.Status,
+		StatusCode:    r.StatusCode,
+		Proto:         r.Proto,
+		ContentLength: r.ContentLength,
+		Header:        r.Header,
+		Body:          body,
+	}
+}
+
+// NewSessionResponse returns the response to send for a http session, the matching AutoResponse or the session info
+// json. The AutoResponse used is returned as well.
+func NewSessionResponse(session *Session, req *http.Request) (*HTTPResponseJSON, *AutoResponse) {
+	response := &HTTPResponseJSON{
+		Time:       time.Now().UTC().Format(JavascriptISOString),
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		Header:     make(map[string][]string),
+	}
+	response.Header["X-Session-Key"] = []string{session.Key}
+	response.Header["X-Session-Info-URL"] = []string{fmt.Sprintf("%s/api/info/%s", *publicUrl, session.Key)}
+	response.Header["Content-Type"] = []string{"application/json; charset=utf-8"}
+
+	var autoResponse *AutoResponse
+	if bin, ok := Bins.Get(session.BinName()); ok {
+		autoResponse = bin.Find(req)
+	}
+	if autoResponse == nil {
+		autoResponse = autoResponders.Find(req)
+	}
+	if autoResponse != nil {
+		response.StatusCode = autoResponse.StatusCode
+		response.Header["Content-Type"] = []string{autoResponse.ContentType}
+		response.Header["X-AutoResponder-Name"] = []string{autoResponse.Name}
+
+		if autoResponse.ResponseHeaders != nil {
+			for k, v := range autoResponse.ResponseHeaders {
+				response.Header[http.CanonicalHeaderKey(k)] = []string{v}
+			}
+		}
+		response.Body = []byte(autoResponse.Response)
+	} else {
+		sessionInfo := createNewSessionResponse(session)
+		response.Body, _ = json.MarshalIndent(sessionInfo, "", "    ")
+	}
+
+	response.Status = fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode))
+	response.ContentLength = int64(len(response.Body))
+	return response, autoResponse
+}
+
 // ByteCountDecimal return a human-readable form of the number of bytes
 func ByteCountDecimal(b int64) string {
 	const unit = 1000
@@ -0,0 +1,124 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SessionKeyVersion current version of the session key format.
+//
+//	version 1: hashids of the unix time in seconds.
+//	version 2: hashids of the unix time in seconds, a process wide counter and a random value.
+const SessionKeyVersion = 2
+
+// sessionKeyCounter counter used to keep session keys unique within the same second
+var sessionKeyCounter uint32
+
+// NewSessionKey returns a new url safe session key that is not in use by another session.
+func NewSessionKey() (string, error) {
+	for i := 0; i < 10; i++ {
+		var rnd [4]byte
+		_, err := rand.Read(rnd[:])
+		if err != nil {
+			return "", err
+		}
+
+		hashKey := []int64{
+			time.Now().Unix(),
+			int64(atomic.AddUint32(&sessionKeyCounter, 1)),
+			int64(binary.BigEndian.Uint32(rnd[:]) & 0x7fffffff),
+		}
+
+		key, err := hasher.EncodeInt64(hashKey)
+		if err != nil {
+			return "", err
+		}
+
+		if !sessionKeyExists(key) {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("unable to generate unique session key")
+}
+
+// SessionKeyFormat returns the version of the key format used to create a session key, 0 if the key is unknown.
+func SessionKeyFormat(key string) int {
+	values, err := hasher.DecodeInt64WithError(key)
+	if err != nil {
+		return 0
+	}
+
+	switch len(values) {
+	case 1:
+		return 1
+	case 3:
+		return 2
+	}
+	return 0
+}
+
+func sessionKeyExists(key string) bool {
+	if _, ok := Sessions.Get(key); ok {
+		return true
+	}
+
+	if store == nil {
+		return false
+	}
+
+	_, err := store.GetSession(key)
+	return err == nil
+}
+
+// MigrateSessionKeys upgrades the key format recorded in the storage backend. Sessions are looked up by their key
+// string, so sessions created with an earlier key format keep resolving at /v/:name and /t/:name; entries stored under
+// a key that differs from the session key are re-keyed.
+func MigrateSessionKeys() error {
+	raw, err := store.GetRecord(MetaBucket, "sessionKeyVersion")
+	if err == nil && string(raw) == fmt.Sprintf("%d", SessionKeyVersion) {
+		return nil
+	}
+
+	legacy := 0
+	rekey := make(map[string]*Session)
+	err = store.ForEachSession(func(key string, raw []byte) error {
+		s := &Session{}
+		if json.Unmarshal(raw, s) != nil {
+			return nil
+		}
+
+		if SessionKeyFormat(s.Key) == 1 {
+			legacy++
+		}
+
+		if s.Key != "" && s.Key != key {
+			rekey[key] = s
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, s := range rekey {
+		err = store.PutSession(s.Key, s.Bytes())
+		if err != nil {
+			return err
+		}
+		err = store.DeleteSession(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Migrated session keys to version %d, legacy keys: %d re-keyed: %d\n", SessionKeyVersion, legacy, len(rekey))
+	return store.PutRecord(MetaBucket, "sessionKeyVersion", []byte(fmt.Sprintf("%d", SessionKeyVersion)))
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"strings"
+)
+
+// mailMessageFile name of the raw message in the MultiPartFiles of a mail session
+const mailMessageFile = "message.eml"
+
+// maxMailParts upper bound of the MIME parts of a message that are decoded, nested multiparts included
+const maxMailParts = 100
+
+// MailMessage struct to store the envelope and the decoded content of a mail received by the SMTP listener. The
+// attachments are saved in the MultiPartFiles of the session, along with the raw message.
+type MailMessage struct {
+	Helo        string              `json:"helo"`
+	User        string              `json:"user,omitempty"`
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Header      map[string][]string `json:"header"`
+	Subject     string              `json:"subject"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []string            `json:"attachments,omitempty"`
+	ParseError  string              `json:"parseError,omitempty"`
+}
+
+// InitializeMail update the Session with the mail received in a SMTP transaction, data is the message as sent after DATA
+func (s *Session) InitializeMail(msg *MailMessage, data []byte) {
+	err := saveSessionFile(s, mailMessageFile, bytes.NewReader(data))
+	if err != nil {
+		fmt.Printf("Session %s unable to save the message: %v\n", s.Key, err)
+	}
+
+	err = s.parseMail(msg, data)
+	if err != nil {
+		msg.ParseError = err.Error()
+	}
+
+	s.mu.Lock()
+	s.Protocol = Mail
+	s.MailSession = msg
+	dump, _ := json.MarshalIndent(msg, "", "    ")
+	_, _ = s.outputFile.Write(dump)
+	s.mu.Unlock()
+	Sessions.Reindex(s)
+
+	Broadcast(SessionUpdated, s.ToApiSession())
+}
+
+// LoadMailJSON load the mail data file from disk if it is a mail session.
+func (s *Session) LoadMailJSON() error {
+	if s.Protocol != Mail {
+		return fmt.Errorf("not a mail session")
+	}
+
+	raw, err := ReadBlob(s.SaveFile)
+	if err != nil {
+		return err
+	}
+
+	msg := &MailMessage{}
+	err = json.Unmarshal(raw, msg)
+	if err != nil {
+		return err
+	}
+
+	s.MailSession = msg
+	return nil
+}
+
+// parseMail decodes the headers and the MIME parts of the message, the first text/plain and text/html parts are the
+// bodies, other parts are saved as attachments
+func (s *Session) parseMail(msg *MailMessage, data []byte) error {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	dec := &mime.WordDecoder{}
+	msg.Header = make(map[string][]string, len(m.Header))
+	for name, values := range m.Header {
+		for _, v := range values {
+			if decoded, err := dec.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			msg.Header[name] = append(msg.Header[name], v)
+		}
+	}
+	msg.Subject = mail.Header(msg.Header).Get("Subject")
+
+	parts := 0
+	return s.parseMailPart(msg, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Header.Get("Content-Disposition"), m.Body, &parts)
+}
+
+func (s *Session) parseMailPart(msg *MailMessage, contentType, encoding, disposition string, body io.Reader, parts *int) error {
+	*parts++
+	if *parts > maxMailParts {
+		return fmt.Errorf("more than %d parts", maxMailParts)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = s.parseMailPart(msg, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part, parts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	dispositionType, dispositionParams, _ := mime.ParseMediaType(disposition)
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	if dispositionType != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && msg.Text == "":
+			content, err := io.ReadAll(body)
+			msg.Text = string(content)
+			return err
+		case mediaType == "text/html" && msg.HTML == "":
+			content, err := io.ReadAll(body)
+			msg.HTML = string(content)
+			return err
+		}
+	}
+
+	name := s.attachmentName(filename, len(msg.Attachments)+1)
+	err = saveSessionFile(s, name, body)
+	if err != nil {
+		return err
+	}
+	msg.Attachments = append(msg.Attachments, name)
+	return nil
+}
+
+// attachmentName returns a file name for an attachment that is not in use by the session
+func (s *Session) attachmentName(filename string, index int) string {
+	if decoded, err := (&mime.WordDecoder{}).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		name = fmt.Sprintf("attachment-%d", index)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.MultiPartFiles[name]; ok || name == mailMessageFile {
+		name = fmt.Sprintf("%d-%s", index, name)
+	}
+	return name
+}
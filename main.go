@@ -47,12 +47,40 @@ var (
 	OsSignal chan os.Signal
 
 	saveDir           = goopt.String([]string{"--saveDir"}, "/tmp", "save directory")
+	storageBackend    = goopt.String([]string{"--storage"}, "bolt", "storage backend, bolt (dumpr.db and session files in --saveDir) or sqlite (dumpr.sqlite in --saveDir)")
 	webDir            = goopt.String([]string{"--webDir"}, "/tmp/web", "web assets directory")
 	serverHost        = goopt.String([]string{"--host"}, "0.0.0.0", "host for server")
 	publicUrl         = goopt.String([]string{"--publicUrl"}, "http://127.0.0.1:8080", "public url")
 	publicBinEndpoint = goopt.String([]string{"--publicBinEndpoint"}, "127.0.0.1 8081", "public binary ip/port")
 	httpPort          = goopt.Int([]string{"--port"}, 8080, "port for server")
 	tcpPort           = goopt.Int([]string{"--tcpPort"}, 8081, "tcp port for server")
+	tlsPort           = goopt.Int([]string{"--tlsPort"}, 0, "tls port for server. 0 will disable.")
+	smtpPort          = goopt.Int([]string{"--smtpPort"}, 0, "smtp port for server, received mail is captured. 0 will disable.")
+	udpPort           = goopt.Int([]string{"--udpPort"}, 0, "udp port for server, datagrams are grouped by source address. 0 will disable.")
+	udpIdleTimeoutStr = goopt.String([]string{"--udpIdleTimeout"}, "30s", "udp: shut down the session of a source address that sent no datagram for value")
+	tlsCertFile       = goopt.String([]string{"--tlsCert"}, "", "tls certificate file, a self-signed certificate is created in --saveDir if not set")
+	tlsKeyFile        = goopt.String([]string{"--tlsKey"}, "", "tls key file")
+	forwardTo         = goopt.String([]string{"--forward"}, "", "host:port to proxy tcp and tls connections to, both directions are recorded")
+	replayTo          = goopt.String([]string{"--to"}, "", "replay: host:port to send the session to")
+	replayTiming      = goopt.Flag([]string{"--timing"}, nil, "replay: honor the original timing between chunks", "")
+	replayWait        = goopt.String([]string{"--replayWait"}, "2s", "replay: time to wait for a response from the target")
+	exportBlobs       = goopt.Flag([]string{"--blobs"}, nil, "db export: include the session payloads", "")
+	binDomain         = goopt.String([]string{"--binDomain"}, "", "domain of the <bin>.domain hosts that capture into a named bin, e.g. florida.dumpr.io")
+	authEnabled       = goopt.Flag([]string{"--auth"}, nil, "require a login, api token or bin secret for the web ui and apis", "")
+	authRole          = goopt.String([]string{"--role"}, "read", "user/token: role of the user or token, read or admin")
+	authPassword      = goopt.String([]string{"--password"}, "", "user: password of the user")
+	listeners         = goopt.Strings([]string{"--listen"}, "port[,tls][,proxy][,smtp][,forward=host:port] or port,udp", "additional tcp or udp listener")
+	proxyProtocol     = goopt.Flag([]string{"--proxyProtocol"}, nil, "read the PROXY protocol header sent by a trusted proxy on the --tcpPort, --tlsPort and --smtpPort listeners", "")
+	trustedProxies    = goopt.Strings([]string{"--trustedProxy"}, "ip|cidr", "proxy whose PROXY header or X-Forwarded-For is trusted, may be repeated")
+
+	redactHeaders      = goopt.Strings([]string{"--redactHeader"}, "name", "header to mask before a session is saved, may be repeated")
+	redactFields       = goopt.Strings([]string{"--redactField"}, "$.path|field", "json path or form field to mask before a session is saved, may be repeated")
+	redactRegexes      = goopt.Strings([]string{"--redactRegex"}, "regex", "pattern to mask in http bodies and tcp traffic before a session is saved, may be repeated")
+	noDefaultRedaction = goopt.Flag([]string{"--noDefaultRedaction"}, nil, "do not mask the Authorization, Cookie and api key headers by default", "")
+
+	protocolRetention = goopt.Strings([]string{"--protocolRetention"}, "protocol=duration", "how long sessions of a protocol are kept, e.g. tcp=1h, may be repeated")
+	maxSessions       = goopt.Int([]string{"--maxSessions"}, 0, "purge the oldest sessions while there are more than value. 0 will disable.")
+	maxDiskUsage      = goopt.String([]string{"--maxDiskUsage"}, "0", "purge the oldest sessions while their files use more than value, e.g. 10GB. 0 will disable.")
 
 	exportTemplates   = goopt.Flag([]string{"--export"}, nil, "export templates to --webDir value.", "")
 	purgeOlderThanStr = goopt.String([]string{"--purgeOlderThan"}, "24h", "Purge sessions from disk older than value. 0 will disable.")
@@ -67,6 +95,7 @@ var (
 	purgeOlderThan          *durafmt.Durafmt
 	maxSessionSize          int
 	maxSessionSizeFormatted string
+	udpIdleTimeout          time.Duration
 )
 
 func init() {
@@ -75,7 +104,15 @@ func init() {
 		return "Http and TCP logger endpoint"
 	}
 	goopt.Author = "Alex Jeannopoulos"
-	goopt.ExtraUsage = ``
+	goopt.ExtraUsage = `
+Commands:
+  dumpr replay <key> --to host:port [--timing]     replay a recorded tcp session against a target, the server must
+                                                   be stopped, use POST /api/replay/:name on a running server
+  dumpr user add <name> --password <pw> [--role admin]  add a user for the web ui and basic auth
+  dumpr user remove <name> | list                  remove or list users
+  dumpr token create <name> [--role admin]         create an api token
+  dumpr token revoke <name> | list                 revoke or list api tokens
+`
 	goopt.Summary = `
 dumpr
         dumpr will create and http and tcp listener and log connections and inbound traffic to a log file.
@@ -94,9 +131,6 @@ dumpr
   Built By        : %s
 `, Version, GitRepo, LatestCommit, Branch, CommitDate, BuildDate, BuiltBy)
 
-	//Parse options
-	goopt.Parse(nil)
-
 	var err error
 	duraFormatOverride, err = durafmt.DefaultUnitsCoder.Decode("y:y,w:w,d:d,h:h,m:m,s:s,ms:ms,μs:μs")
 	if err != nil {
@@ -105,6 +139,9 @@ dumpr
 }
 
 func main() {
+	// options are parsed in main, not init, so go test can run with its own flags
+	goopt.Parse(nil)
+
 	var err error
 	purgeOlderThan, err = durafmt.ParseString(*purgeOlderThanStr)
 	if err != nil {
@@ -112,6 +149,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	udpIdleTimeout, err = time.ParseDuration(*udpIdleTimeoutStr)
+	if err == nil && udpIdleTimeout <= 0 {
+		err = fmt.Errorf("must be greater than 0")
+	}
+	if err != nil {
+		fmt.Printf("Invalid field: udpIdleTimeout - %v\n", err)
+		os.Exit(1)
+	}
+
 	maxSessionSize = *maxSessionSz << (10 * 2) // 2 refers to the constants ByteSize MB
 
 	maxSessionSizeFormatted = ByteCountDecimal(int64(maxSessionSize))
@@ -158,15 +204,46 @@ func main() {
 		return
 	}
 
-	db, err = InitializeDB()
+	store, err = InitializeDB()
 	if err != nil {
 		fmt.Printf("Error initializing db, error: %v\n", err)
 		return
 	}
 	defer func() {
-		_ = db.Close()
+		_ = store.Close()
 	}()
 
+	if len(goopt.Args) > 0 && goopt.Args[0] == "db" {
+		err = runDBCommand(goopt.Args[1:])
+		if err != nil {
+			fmt.Printf("Error running db, error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = InitializeRedaction()
+	if err != nil {
+		fmt.Printf("Invalid field: redaction - %v\n", err)
+		return
+	}
+
+	err = InitializeAuth()
+	if err != nil {
+		fmt.Printf("Error loading users and tokens, error: %v\n", err)
+		return
+	}
+
+	// commands run before LoadSessions, they load what they need and must not remove the invalid sessions of the db
+	if len(goopt.Args) > 0 {
+		err = runCommand(goopt.Args[0], goopt.Args[1:])
+		if err != nil {
+			fmt.Printf("Error running %s, error: %v\n", goopt.Args[0], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	sessionList, err := LoadSessions()
 	if err != nil {
 		fmt.Printf("Error loading sessions, error: %v\n", err)
@@ -174,10 +251,26 @@ func main() {
 	}
 	fmt.Printf("Loaded from db %d sessions\n", len(sessionList))
 
-	if purgeOlderThan.Duration() > 0 {
-		go LaunchSessionReaper()
+	err = InitializeBins()
+	if err != nil {
+		fmt.Printf("Error loading bins, error: %v\n", err)
+		return
+	}
+
+	err = InitializeTrustedProxies()
+	if err != nil {
+		fmt.Printf("Invalid field: trustedProxy - %v\n", err)
+		return
+	}
+
+	err = InitializeRetention()
+	if err != nil {
+		fmt.Printf("Invalid field: retention - %v\n", err)
+		return
 	}
 
+	go LaunchSessionReaper()
+
 	go LaunchSessionUpdater()
 
 	err = InitializeAutoResponders()
@@ -192,10 +285,42 @@ func main() {
 		return
 	}
 
-	err = SpawnTCPListener(*serverHost, *tcpPort)
-	if err != nil {
-		fmt.Printf("Error launching tcp endpoint, error: %v\n", err)
-		return
+	listenerConfigs := []*ListenerConfig{{Host: *serverHost, Port: *tcpPort, Forward: *forwardTo, ProxyProtocol: *proxyProtocol}}
+	if *tlsPort > 0 {
+		listenerConfigs = append(listenerConfigs, &ListenerConfig{Host: *serverHost, Port: *tlsPort, TLS: true, Forward: *forwardTo, ProxyProtocol: *proxyProtocol})
+	}
+	if *smtpPort > 0 {
+		listenerConfigs = append(listenerConfigs, &ListenerConfig{Host: *serverHost, Port: *smtpPort, SMTP: true, ProxyProtocol: *proxyProtocol})
+	}
+	if *udpPort > 0 {
+		listenerConfigs = append(listenerConfigs, &ListenerConfig{Host: *serverHost, Port: *udpPort, UDP: true})
+	}
+
+	for _, v := range *listeners {
+		config, err := ParseListenerConfig(*serverHost, v)
+		if err != nil {
+			fmt.Printf("Invalid field: listen - %v\n", err)
+			return
+		}
+		listenerConfigs = append(listenerConfigs, config)
+	}
+
+	for _, config := range listenerConfigs {
+		if config.ProxyProtocol && len(trustedProxyNets) == 0 {
+			fmt.Printf("Listener %s reads PROXY headers but no --trustedProxy is set, the headers are ignored\n", config)
+		}
+	}
+
+	for _, config := range listenerConfigs {
+		if config.UDP {
+			err = SpawnUDPListener(config, udpIdleTimeout)
+		} else {
+			err = SpawnTCPListener(config)
+		}
+		if err != nil {
+			fmt.Printf("Error launching endpoint %s, error: %v\n", config, err)
+			return
+		}
 	}
 
 	LoopForever(func() {
@@ -205,31 +330,26 @@ func main() {
 	})
 }
 
-// LaunchSessionReaper launches the session reaper that will clean up sessions older than purgeOlderThan option.
+func runCommand(cmd string, args []string) error {
+	switch cmd {
+	case "replay":
+		return runReplayCommand(args)
+	case "user":
+		return runUserCommand(args)
+	case "token":
+		return runTokenCommand(args)
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+// LaunchSessionReaper launches the session reaper that will purge the sessions selected by the retention policy.
 func LaunchSessionReaper() {
 	fmt.Printf("launching cleanup process, will delete sessions older than %v\n", purgeOlderThan)
 
 	for {
 		fmt.Printf("Running session cleanup: %v+\n", time.Now().Format(time.ANSIC))
-
-		purgeSessionList := make([]*Session, 0)
-		for _, v := range Sessions {
-			purgeTime := v.StartTime.Add(purgeOlderThan.Duration())
-
-			//fmt.Printf("Session Start Time%v : %v\n", v.StartTime, purgeTime)
-
-			if time.Now().After(purgeTime) && !v.Active {
-				//fmt.Printf("File older than %v : %v\n", purgeOlderThan, purgeTime)
-				purgeSessionList = append(purgeSessionList, v)
-			}
-		}
-
-		for _, v := range purgeSessionList {
-			//fmt.Printf("[%d] purging session: %s\n", i, v.Key)
-			PurgeSession(v)
-		}
-
-		time.Sleep(time.Minute * 1)
+		ApplyRetention(time.Now())
+		time.Sleep(reaperInterval)
 	}
 }
 
@@ -238,8 +358,8 @@ func LaunchSessionUpdater() {
 	fmt.Printf("launching session updater process, will update sessions every 10 seconds\n")
 
 	for {
-		for _, v := range Sessions {
-			if v.Active {
+		for _, v := range Sessions.List() {
+			if v.IsActive() {
 				Broadcast(SessionUpdated, v.ToApiSession())
 			}
 		}
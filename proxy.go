@@ -0,0 +1,74 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// forwardConn proxies the client connection to the upstream host:port, recording the traffic of both directions in the
+// session until either side closes or the max session size is reached.
+func forwardConn(session *Session, client net.Conn, upstream string) {
+	session.SetUpstream(upstream)
+
+	target, err := net.DialTimeout("tcp", upstream, 10*time.Second)
+	if err != nil {
+		// nothing is recorded, the client was never sent anything
+		fmt.Printf("Session %s unable to connect to upstream %s: %v\n", session.Key, upstream, err)
+		return
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		_ = client.Close()
+		_ = target.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn, dir Direction) {
+		defer wg.Done()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				pay := buf[:n]
+				total := session.Record(dir, pay)
+
+				// the recorded chunk is forwarded before the connection is cut at the max session size
+				_, werr := dst.Write(pay)
+				if werr != nil {
+					once.Do(closeBoth)
+					return
+				}
+				if total >= int64(maxSessionSize) {
+					fmt.Printf("Shuting down session: %s max session size reached: %d\n", session.Key, maxSessionSize)
+					once.Do(closeBoth)
+					return
+				}
+			}
+			if err == io.EOF {
+				// a half-close is passed on, the other direction keeps flowing until its side closes too
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+					return
+				}
+			}
+			if err != nil {
+				once.Do(closeBoth)
+				return
+			}
+		}
+	}
+
+	go pipe(target, client, Inbound)
+	go pipe(client, target, Outbound)
+	wg.Wait()
+	once.Do(closeBoth)
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// trustedProxyNets networks of the --trustedProxy values
+var trustedProxyNets []*net.IPNet
+
+// ProxyHeader details of a PROXY protocol v1 or v2 header. Source is nil for a LOCAL command or an UNKNOWN or unix
+// address family, the connection was opened by the proxy itself.
+type ProxyHeader struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// InitializeTrustedProxies parses the --trustedProxy values
+func InitializeTrustedProxies() error {
+	nets, err := ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxyNets = nets
+	return nil
+}
+
+// ParseTrustedProxies returns the networks of ip addresses and cidr ranges
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", v, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy returns true if the PROXY header sent by the peer is honored, only peers in a --trustedProxy network
+// are trusted so no peer is trusted when none is set
+func isTrustedProxy(peer string) bool {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyHeader reads the PROXY header a trusted peer sent at the start of the connection, the session IP becomes the
+// source address of the header and the peer is kept as the hop. A header that is not honored is left in the stream, it
+// is recorded as traffic.
+func acceptProxyHeader(session *Session, client net.Conn, b *bufio.Reader) {
+	if sniffStream(client, b, []*Sniffer{{Name: "proxy", Match: matchProxyHeader}}) == nil {
+		return
+	}
+
+	peer := session.IP
+	if !isTrustedProxy(peer) {
+		fmt.Printf("Session %s proxy header from untrusted peer %s ignored\n", session.Key, peer)
+		return
+	}
+
+	raw, err := readProxyHeader(b)
+	if err != nil {
+		fmt.Printf("Session %s invalid proxy header: %v\n", session.Key, err)
+		return
+	}
+
+	header, err := ParseProxyHeader(raw)
+	if err != nil {
+		fmt.Printf("Session %s invalid proxy header: %v\n", session.Key, err)
+		session.Record(Inbound, raw)
+		return
+	}
+	if header.Source != nil {
+		session.SetClientIP(header.Source.IP.String())
+	}
+}
+
+// ParseProxyHeader parses a PROXY protocol v1 line or v2 binary header returned by readProxyHeader
+func ParseProxyHeader(raw []byte) (*ProxyHeader, error) {
+	if bytes.HasPrefix(raw, []byte(proxyV2Signature)) {
+		return parseProxyHeaderV2(raw)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(raw), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid v1 header %q", raw)
+	}
+
+	header := &ProxyHeader{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("invalid v1 header %q", raw)
+	}
+
+	var err error
+	header.Source, err = proxyHeaderAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	header.Destination, err = proxyHeaderAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func proxyHeaderAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyHeaderV2 parses the binary header, the signature is followed by the version and command, the address
+// family, the length of the addresses then the addresses
+func parseProxyHeaderV2(raw []byte) (*ProxyHeader, error) {
+	if len(raw) < 16 {
+		return nil, fmt.Errorf("v2 header is %d bytes", len(raw))
+	}
+	if raw[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid v2 header version %d", raw[12]>>4)
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch raw[12] & 0x0f {
+	case 0x00: // LOCAL
+		return header, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("invalid v2 header command %d", raw[12]&0x0f)
+	}
+
+	addrs := raw[16:]
+	var size int
+	switch raw[13] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX
+		return header, nil
+	}
+	if len(addrs) < 2*size+4 {
+		return nil, fmt.Errorf("v2 header addresses are %d bytes", len(addrs))
+	}
+
+	header.Source = &net.TCPAddr{IP: net.IP(addrs[:size]), Port: int(binary.BigEndian.Uint16(addrs[2*size:]))}
+	header.Destination = &net.TCPAddr{IP: net.IP(addrs[size : 2*size]), Port: int(binary.BigEndian.Uint16(addrs[2*size+2:]))}
+	return header, nil
+}
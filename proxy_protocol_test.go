@@ -0,0 +1,31 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestIsTrustedProxy(t *testing.T) {
+	trustedProxyNets = nil
+	if isTrustedProxy("127.0.0.1") || isTrustedProxy("203.0.113.7") {
+		t.Errorf("peer trusted without a --trustedProxy")
+	}
+
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxyNets = nets
+	defer func() {
+		trustedProxyNets = nil
+	}()
+
+	for peer, want := range map[string]bool{"10.1.2.3": true, "203.0.113.7": true, "203.0.113.8": false, "bad": false} {
+		if got := isTrustedProxy(peer); got != want {
+			t.Errorf("isTrustedProxy(%q) = %t, want %t", peer, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestForwardHalfClose the upstream answers after the client closed its writing side, the answer must reach the client
+func TestForwardHalfClose(t *testing.T) {
+	setupTestServer(t)
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("got "), request...))
+	}()
+
+	addr := listenTestTCP(t, &ListenerConfig{Host: "127.0.0.1", Forward: upstream.Addr().String()})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "got request" {
+		t.Errorf("response %q, want %q", response, "got request")
+	}
+}
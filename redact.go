@@ -0,0 +1,470 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// RedactedValue replaces the masked values
+const RedactedValue = "[REDACTED]"
+
+// defaultRedactedHeaders headers masked unless --noDefaultRedaction is set
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// maxRedactMatch the longest match a --redactRegex may have, the length of the traffic held back to find matches split
+// across two reads
+const maxRedactMatch = 4096
+
+// Redactor masks sensitive headers, body fields and patterns before a session is persisted
+type Redactor struct {
+	headers map[string]bool
+	fields  [][]string
+	regexes []*regexp.Regexp
+	// window the longest match of the regexes in bytes, see RedactStream
+	window int
+}
+
+var redactor = &Redactor{headers: make(map[string]bool)}
+
+// NewRedactor creates a Redactor. fields are form field names or json paths in the form $.user.password or
+// user.password, a * element matches any key or array index. regexes are applied to bodies and tcp traffic, their
+// matches must have a bounded length of at most maxRedactMatch bytes, e.g. \d{1,19} instead of \d+.
+func NewRedactor(headers, fields, regexes []string) (*Redactor, error) {
+	r := &Redactor{headers: make(map[string]bool)}
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h != "" {
+			r.headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	for _, f := range fields {
+		f = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(f), "$"), ".")
+		if f != "" {
+			r.fields = append(r.fields, strings.Split(f, "."))
+		}
+	}
+
+	for _, v := range regexes {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction regex %q: %v", v, err)
+		}
+
+		parsed, err := syntax.Parse(v, syntax.Perl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction regex %q: %v", v, err)
+		}
+		n, bounded := maxMatchLength(parsed)
+		if !bounded || n > maxRedactMatch {
+			return nil, fmt.Errorf("redaction regex %q can match more than %d bytes, bound its repetitions, e.g. {1,32} instead of + or *", v, maxRedactMatch)
+		}
+		if n > r.window {
+			r.window = n
+		}
+		r.regexes = append(r.regexes, re)
+	}
+	return r, nil
+}
+
+// maxMatchLength returns the length in bytes of the longest text the regex can match, false if it is unbounded
+func maxMatchLength(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		n := 0
+		for _, c := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 {
+				n += utf8.UTFMax
+			} else {
+				n += utf8.RuneLen(c)
+			}
+		}
+		return n, true
+	case syntax.OpCharClass:
+		n := 0
+		for i := 1; i < len(re.Rune); i += 2 {
+			l := utf8.RuneLen(re.Rune[i])
+			if l < 0 {
+				l = utf8.UTFMax
+			}
+			if l > n {
+				n = l
+			}
+		}
+		return n, true
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return utf8.UTFMax, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxMatchLength(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus:
+		return 0, false
+	case syntax.OpRepeat:
+		n, bounded := maxMatchLength(re.Sub[0])
+		if !bounded || re.Max < 0 {
+			return 0, false
+		}
+		if n > 0 && re.Max > maxRedactMatch/n {
+			return maxRedactMatch + 1, true
+		}
+		return n * re.Max, true
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n, bounded := maxMatchLength(sub)
+			if !bounded {
+				return 0, false
+			}
+			if re.Op == syntax.OpConcat {
+				total += n
+			} else if n > total {
+				total = n
+			}
+		}
+		return total, true
+	}
+	// empty matches and assertions, ^ $ \b
+	return 0, true
+}
+
+// InitializeRedaction builds the redactor from the --redactHeader, --redactField and --redactRegex options
+func InitializeRedaction() error {
+	headers := append([]string(nil), *redactHeaders...)
+	if !*noDefaultRedaction {
+		headers = append(headers, defaultRedactedHeaders...)
+	}
+
+	r, err := NewRedactor(headers, *redactFields, *redactRegexes)
+	if err != nil {
+		return err
+	}
+	redactor = r
+	return nil
+}
+
+// RedactRequest masks the headers, form values and body of the request, the list of what was masked is stored in
+// request.Redacted. The maps of request are replaced by masked copies, the http.Request they were taken from is left
+// as it is.
+func (r *Redactor) RedactRequest(request *HTTPRequestJSON) {
+	masked := make(map[string]bool)
+
+	request.Header = r.redactHeaders(request.Header, masked)
+	request.Form = r.redactValues(request.Form, masked)
+	request.PostForm = r.redactValues(request.PostForm, masked)
+	if request.MultipartForm != nil {
+		form := *request.MultipartForm
+		form.Value = r.redactValues(form.Value, masked)
+		request.MultipartForm = &form
+	}
+
+	contentType := http.Header(request.Header).Get("Content-Type")
+	request.Body = r.redactBody(contentType, request.Body, masked)
+	request.Redacted = maskedList(masked)
+}
+
+// RedactResponse masks the headers and body of a response received by dumpr, e.g. of a resend, returns what was masked
+func (r *Redactor) RedactResponse(response *HTTPResponseJSON) []string {
+	masked := make(map[string]bool)
+
+	response.Header = r.redactHeaders(response.Header, masked)
+	contentType := http.Header(response.Header).Get("Content-Type")
+	response.Body = r.redactBody(contentType, response.Body, masked)
+	return maskedList(masked)
+}
+
+// RedactCopy copies src to dst with the regexes masked, as RedactStream does for tcp traffic. Returns the bytes written
+// and the regexes that matched.
+func (r *Redactor) RedactCopy(dst io.Writer, src io.Reader) (int64, []string, error) {
+	masked := make(map[string]bool)
+	var written int64
+	var held []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		final := err != nil
+		if n > 0 || final {
+			var out []byte
+			var m []string
+			out, held, m = r.RedactStream(held, buf[:n], final)
+			for _, v := range m {
+				masked[v] = true
+			}
+			w, werr := dst.Write(out)
+			written += int64(w)
+			if werr != nil {
+				return written, maskedList(masked), werr
+			}
+		}
+		if err == io.EOF {
+			return written, maskedList(masked), nil
+		}
+		if err != nil {
+			return written, maskedList(masked), err
+		}
+	}
+}
+
+// maskedList returns the sorted list of the masked items, nil if nothing was masked
+func maskedList(masked map[string]bool) []string {
+	if len(masked) == 0 {
+		return nil
+	}
+
+	list := make([]string, 0, len(masked))
+	for k := range masked {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// RedactStream masks the regexes in the traffic held back from the previous chunk followed by pay, returns the traffic
+// to record, the traffic to hold back for the next call and the regexes that matched. Unless final is set, the end of
+// the traffic, as long as the longest match a regex can have, and any match reaching into it are held back so a match
+// split across two chunks is still found. pay is not modified.
+func (r *Redactor) RedactStream(held, pay []byte, final bool) ([]byte, []byte, []string) {
+	if len(r.regexes) == 0 {
+		if len(held) == 0 {
+			return pay, nil, nil
+		}
+		return append(held, pay...), nil, nil
+	}
+
+	buf := append(append(make([]byte, 0, len(held)+len(pay)), held...), pay...)
+	cut := len(buf)
+	if !final {
+		cut -= r.window
+		if cut < 0 {
+			cut = 0
+		}
+		for moved := true; moved; {
+			moved = false
+			for _, re := range r.regexes {
+				for _, loc := range re.FindAllIndex(buf, -1) {
+					if loc[0] < cut && loc[1] > cut {
+						cut = loc[0]
+						moved = true
+					}
+				}
+			}
+		}
+	}
+
+	out := buf[:cut]
+	var rest []byte
+	if cut < len(buf) {
+		rest = append([]byte(nil), buf[cut:]...)
+	}
+
+	var masked []string
+	for _, re := range r.regexes {
+		if re.Match(out) {
+			out = re.ReplaceAll(out, []byte(RedactedValue))
+			masked = append(masked, "regex:"+re.String())
+		}
+	}
+	return out, rest, masked
+}
+
+func (r *Redactor) redactHeaders(header map[string][]string, masked map[string]bool) map[string][]string {
+	if header == nil {
+		return nil
+	}
+
+	result := make(map[string][]string, len(header))
+	for k, v := range header {
+		if r.headers[http.CanonicalHeaderKey(k)] {
+			result[k] = []string{RedactedValue}
+			masked["header:"+http.CanonicalHeaderKey(k)] = true
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+func (r *Redactor) redactValues(values map[string][]string, masked map[string]bool) map[string][]string {
+	if values == nil || len(r.fields) == 0 {
+		return values
+	}
+
+	result := make(map[string][]string, len(values))
+	for k, v := range values {
+		if r.isField(k) {
+			result[k] = []string{RedactedValue}
+			masked["field:"+k] = true
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// isField returns true if a form field name is one of the redacted fields
+func (r *Redactor) isField(name string) bool {
+	for _, path := range r.fields {
+		if len(path) == 1 && (path[0] == name || path[0] == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) redactBody(contentType string, body []byte, masked map[string]bool) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	if len(r.fields) > 0 {
+		switch {
+		case strings.Contains(contentType, "json"):
+			if doc, ok := decodeJSONBody(body); ok {
+				changed := false
+				for _, path := range r.fields {
+					if redactJSONPath(doc, path) {
+						masked["field:$."+strings.Join(path, ".")] = true
+						changed = true
+					}
+				}
+				if changed {
+					var buf bytes.Buffer
+					encoder := json.NewEncoder(&buf)
+					encoder.SetEscapeHTML(false)
+					if encoder.Encode(doc) == nil {
+						body = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+					}
+				}
+			}
+		case strings.HasPrefix(contentType, "multipart/form-data"):
+			body = r.redactMultipart(contentType, body, masked)
+		case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+			values, err := url.ParseQuery(string(body))
+			if err == nil {
+				changed := false
+				for k := range values {
+					if r.isField(k) {
+						values[k] = []string{RedactedValue}
+						masked["field:"+k] = true
+						changed = true
+					}
+				}
+				if changed {
+					body = []byte(values.Encode())
+				}
+			}
+		}
+	}
+
+	for _, re := range r.regexes {
+		if re.Match(body) {
+			body = re.ReplaceAll(body, []byte(RedactedValue))
+			masked["regex:"+re.String()] = true
+		}
+	}
+	return body
+}
+
+// redactMultipart rebuilds a multipart/form-data body with the values of the redacted fields masked, file parts are
+// kept. A body that can not be parsed is masked as a whole, the form values parsed from it may have been masked.
+func (r *Redactor) redactMultipart(contentType string, body []byte, masked map[string]bool) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	boundary := params["boundary"]
+	if err != nil || boundary == "" {
+		masked["field:multipart"] = true
+		return []byte(RedactedValue)
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	err = w.SetBoundary(boundary)
+	changed := false
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for err == nil {
+		var part *multipart.Part
+		part, err = reader.NextRawPart()
+		if err != nil {
+			break
+		}
+
+		var dst io.Writer
+		dst, err = w.CreatePart(part.Header)
+		if err != nil {
+			break
+		}
+
+		name := part.FormName()
+		if name != "" && part.FileName() == "" && r.isField(name) {
+			masked["field:"+name] = true
+			changed = true
+			_, err = io.WriteString(dst, RedactedValue)
+		} else {
+			_, err = io.Copy(dst, part)
+		}
+	}
+	if err != io.EOF {
+		masked["field:multipart"] = true
+		return []byte(RedactedValue)
+	}
+	if !changed {
+		return body
+	}
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// redactJSONPath replaces the values at path in a decoded json document, returns true if a value was replaced
+func redactJSONPath(doc interface{}, path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	key, last := path[0], len(path) == 1
+	changed := false
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			if key != "*" && key != k {
+				continue
+			}
+			if last {
+				node[k] = RedactedValue
+				changed = true
+				continue
+			}
+			changed = redactJSONPath(v, path[1:]) || changed
+		}
+	case []interface{}:
+		for i, v := range node {
+			if key != "*" && key != fmt.Sprintf("%d", i) {
+				continue
+			}
+			if last {
+				node[i] = RedactedValue
+				changed = true
+				continue
+			}
+			changed = redactJSONPath(v, path[1:]) || changed
+		}
+	}
+	return changed
+}
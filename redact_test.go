@@ -0,0 +1,184 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestRedactMultipartBody(t *testing.T) {
+	r, err := NewRedactor(nil, []string{"password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	_ = w.WriteField("user", "alice")
+	_ = w.WriteField("password", "hunter2")
+	f, _ := w.CreateFormFile("upload", "notes.txt")
+	_, _ = f.Write([]byte("file content"))
+	_ = w.Close()
+
+	request := &HTTPRequestJSON{
+		Header: map[string][]string{"Content-Type": {w.FormDataContentType()}},
+		Body:   body.Bytes(),
+	}
+	r.RedactRequest(request)
+
+	if bytes.Contains(request.Body, []byte("hunter2")) {
+		t.Fatalf("password left in body:\n%s", request.Body)
+	}
+
+	form, err := multipart.NewReader(bytes.NewReader(request.Body), w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("redacted body is not a valid multipart body: %v", err)
+	}
+	if got := form.Value["password"]; len(got) != 1 || got[0] != RedactedValue {
+		t.Errorf("password = %v, want %s", got, RedactedValue)
+	}
+	if got := form.Value["user"]; len(got) != 1 || got[0] != "alice" {
+		t.Errorf("user = %v, want alice", got)
+	}
+	if len(form.File["upload"]) != 1 {
+		t.Errorf("file part dropped")
+	}
+	if strings.Join(request.Redacted, ",") != "field:password" {
+		t.Errorf("redacted = %v, want [field:password]", request.Redacted)
+	}
+}
+
+func TestRedactStreamSplitPattern(t *testing.T) {
+	r, err := NewRedactor(nil, nil, []string{"hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorded []byte
+	var held []byte
+	var masked []string
+	for _, chunk := range []string{"password=hun", "ter2 and more", " traffic"} {
+		var out []byte
+		var m []string
+		out, held, m = r.RedactStream(held, []byte(chunk), false)
+		recorded = append(recorded, out...)
+		masked = append(masked, m...)
+	}
+	out, _, m := r.RedactStream(held, nil, true)
+	recorded = append(recorded, out...)
+	masked = append(masked, m...)
+
+	want := "password=" + RedactedValue + " and more traffic"
+	if string(recorded) != want {
+		t.Errorf("recorded %q, want %q", recorded, want)
+	}
+	if len(masked) == 0 {
+		t.Errorf("match not reported")
+	}
+}
+
+func TestRedactJSONKeepsNumbers(t *testing.T) {
+	r, err := NewRedactor(nil, []string{"$.password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &HTTPRequestJSON{
+		Header: map[string][]string{"Content-Type": {"application/json"}},
+		Body:   []byte(`{"id":12345678901234567890,"amount":1.10,"password":"hunter2"}`),
+	}
+	r.RedactRequest(request)
+
+	want := `{"amount":1.10,"id":12345678901234567890,"password":"` + RedactedValue + `"}`
+	if string(request.Body) != want {
+		t.Errorf("body %s, want %s", request.Body, want)
+	}
+}
+
+func TestRedactRegexMaxMatch(t *testing.T) {
+	for pattern, want := range map[string]int{
+		"hunter2":                     7,
+		`\d{4}-\d{4}-\d{4}-\d{4}`:     19,
+		`(?i)token=[a-f0-9]{32}`:      6*4 + 32,
+		`secret|password=\w{1,16}`:    25,
+		`^api_key:\s?[A-Za-z0-9]{40}`: 49,
+	} {
+		r, err := NewRedactor(nil, nil, []string{pattern})
+		if err != nil {
+			t.Errorf("%s: %v", pattern, err)
+			continue
+		}
+		if r.window != want {
+			t.Errorf("%s: window %d, want %d", pattern, r.window, want)
+		}
+	}
+
+	for _, pattern := range []string{`\d+`, `token=.*`, `(ab){2,}`, `x{1,5000}`} {
+		if _, err := NewRedactor(nil, nil, []string{pattern}); err == nil {
+			t.Errorf("%s: accepted an unbounded pattern", pattern)
+		}
+	}
+}
+
+func TestRedactRequestKeepsLiveForm(t *testing.T) {
+	r, err := NewRedactor(nil, []string{"password"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := &multipart.Form{Value: map[string][]string{"password": {"hunter2"}}}
+	request := &HTTPRequestJSON{MultipartForm: live}
+	r.RedactRequest(request)
+
+	if got := request.MultipartForm.Value["password"]; len(got) != 1 || got[0] != RedactedValue {
+		t.Errorf("redacted password = %v, want %s", got, RedactedValue)
+	}
+	if got := live.Value["password"]; len(got) != 1 || got[0] != "hunter2" {
+		t.Errorf("live form password = %v, want it unchanged", got)
+	}
+}
+
+func TestRedactUploadedFile(t *testing.T) {
+	setupTestServer(t)
+	r, err := NewRedactor(nil, nil, []string{"hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor = r
+	t.Cleanup(func() {
+		redactor = &Redactor{headers: make(map[string]bool)}
+	})
+
+	s, err := createSession("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a match split across two reads of the upload is still masked
+	content := strings.Repeat("x", 32*1024-3) + "hunter2 end"
+	err = saveSessionFile(s, "notes.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deactivateSession(s)
+
+	f, ok := s.UploadedFile("notes.txt")
+	if !ok {
+		t.Fatal("file not listed")
+	}
+	saved, err := ReadBlob(f.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("x", 32*1024-3) + RedactedValue + " end"
+	if string(saved) != want || f.Size != int64(len(want)) {
+		t.Errorf("saved %d bytes ending %q, want the match masked", f.Size, saved[len(saved)-20:])
+	}
+	if strings.Join(s.Redacted, ",") != "regex:hunter2" {
+		t.Errorf("redacted = %v, want [regex:hunter2]", s.Redacted)
+	}
+}
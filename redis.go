@@ -0,0 +1,126 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxRESPArgs upper bound of the arguments of a redis command
+const maxRESPArgs = 1024 * 1024
+
+// serveRedisConn records the RESP commands sent on the connection until the client quits or the max session size is
+// reached. Every command is acknowledged so clients keep sending, PING, ECHO, QUIT and COMMAND get their usual reply.
+func serveRedisConn(session *Session, client net.Conn, b *bufio.Reader) {
+	Broadcast(SessionUpdated, session.ToApiSession())
+
+	for {
+		args, raw, err := readRESPCommand(b)
+		if len(raw) > 0 && session.Record(Inbound, raw) >= int64(maxSessionSize) {
+			fmt.Printf("Shuting down session: %s max session size reached: %d\n", session.Key, maxSessionSize)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		reply := redisReply(args)
+		session.Record(Outbound, reply)
+		_, err = client.Write(reply)
+		if err != nil || strings.EqualFold(args[0], "QUIT") {
+			return
+		}
+	}
+}
+
+// redisReply returns the reply sent for a command
+func redisReply(args []string) []byte {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if len(args) > 1 {
+			return respBulkString(args[1])
+		}
+		return []byte("+PONG\r\n")
+	case "ECHO":
+		if len(args) > 1 {
+			return respBulkString(args[1])
+		}
+		return []byte("-ERR wrong number of arguments for 'echo' command\r\n")
+	case "COMMAND":
+		return []byte("*0\r\n")
+	case "HELLO":
+		// clients fall back to RESP2 when HELLO is unknown
+		return []byte("-ERR unknown command 'HELLO'\r\n")
+	}
+	return []byte("+OK\r\n")
+}
+
+func respBulkString(value string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings, or as an inline command, and returns its arguments
+// with the bytes read. Lines are bounded by the read buffer and a command by the max session size.
+func readRESPCommand(b *bufio.Reader) ([]string, []byte, error) {
+	var raw bytes.Buffer
+	readLine := func() (string, error) {
+		line, err := b.ReadSlice('\n')
+		raw.Write(line)
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("line longer than %d bytes", b.Size())
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+
+	line, err := readLine()
+	if err != nil {
+		return nil, raw.Bytes(), err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), raw.Bytes(), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < -1 || count > maxRESPArgs {
+		return nil, raw.Bytes(), fmt.Errorf("invalid array header %q", line)
+	}
+
+	// a null array, *-1, is not a command, the count is not trusted to size the arguments
+	var args []string
+	for i := 0; i < count; i++ {
+		header, err := readLine()
+		if err != nil {
+			return nil, raw.Bytes(), err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, raw.Bytes(), fmt.Errorf("invalid bulk string header %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > maxSessionSize-raw.Len() {
+			return nil, raw.Bytes(), fmt.Errorf("invalid bulk string header %q", header)
+		}
+
+		// the size is not trusted either, the value grows with the bytes actually sent
+		start := raw.Len()
+		_, err = io.CopyN(&raw, b, int64(size)+2)
+		if err != nil {
+			return nil, raw.Bytes(), err
+		}
+		args = append(args, string(raw.Bytes()[start:start+size]))
+	}
+	return args, raw.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadRESPCommandArrayHeaders(t *testing.T) {
+	b := bufio.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n*-1\r\n*-2\r\n"))
+
+	args, _, err := readRESPCommand(b)
+	if err != nil || len(args) != 1 || args[0] != "PING" {
+		t.Fatalf("got %v, %v, want [PING]", args, err)
+	}
+
+	args, raw, err := readRESPCommand(b)
+	if err != nil || len(args) != 0 || string(raw) != "*-1\r\n" {
+		t.Fatalf("null array: got %v, %q, %v, want no arguments", args, raw, err)
+	}
+
+	_, _, err = readRESPCommand(b)
+	if err == nil {
+		t.Fatalf("negative count accepted")
+	}
+}
+
+func TestReadRESPCommandBounds(t *testing.T) {
+	maxSessionSize = 1 << 20
+
+	b := bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", 100)+"\r\n"), 16)
+	_, raw, err := readRESPCommand(b)
+	if err == nil || len(raw) != 16 {
+		t.Errorf("long line: got %d bytes, %v, want an error after 16 bytes", len(raw), err)
+	}
+
+	// the declared size is not allocated up front, the bytes sent are returned
+	b = bufio.NewReader(strings.NewReader("*1\r\n$1000000\r\nshort"))
+	_, raw, err = readRESPCommand(b)
+	if err == nil || string(raw) != "*1\r\n$1000000\r\nshort" {
+		t.Errorf("short value: got %q, %v", raw, err)
+	}
+
+	b = bufio.NewReader(strings.NewReader("*2\r\n$600000\r\n" + strings.Repeat("x", 600000) + "\r\n$600000\r\n"))
+	_, _, err = readRESPCommand(b)
+	if err == nil {
+		t.Errorf("command larger than the max session size accepted")
+	}
+}
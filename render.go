@@ -0,0 +1,262 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/olahol/melody.v1"
+	"io"
+	"strings"
+	"time"
+)
+
+// render formats of the recorded traffic of a session, used by the live view and /t/:name?format=
+const (
+	// RenderText the traffic as is
+	RenderText = "text"
+
+	// RenderHex a hex dump, offset, hex bytes and ascii columns
+	RenderHex = "hex"
+
+	// RenderBase64 base64 of each chunk of traffic on its own line
+	RenderBase64 = "base64"
+)
+
+// RenderFormats the formats accepted by ParseRenderFormat
+var RenderFormats = []string{RenderText, RenderHex, RenderBase64}
+
+// renderChunkSize chunk size used to render stored traffic, a multiple of 16 keeps the hex dump lines aligned
+const renderChunkSize = 4 * 1024
+
+// view frame types sent to the websocket viewers of a session
+const (
+	// FrameHistory the recorded traffic rendered in Format as the Frames list, the viewer clears its output first. The
+	// history is a single message so it is not dropped by the bounded send buffer of the viewer.
+	FrameHistory = "history"
+
+	// FrameData recorded traffic rendered in the format of the viewer
+	FrameData = "data"
+
+	// FrameMarker a change of direction of a forwarded session, or the start of a datagram of a udp session
+	FrameMarker = "marker"
+
+	// FrameStatus a message about the session, e.g. it was shut down
+	FrameStatus = "status"
+)
+
+// ViewFrame typed message sent to the websocket viewers of a session. Content is rendered by the server in the format
+// the viewer selected, a viewer switches format by sending {"type": "format", "format": "hex"}.
+type ViewFrame struct {
+	Type      string       `json:"type"`
+	Format    string       `json:"format,omitempty"`
+	Direction string       `json:"dir,omitempty"`
+	Time      int64        `json:"time,omitempty"`
+	Offset    int64        `json:"offset"`
+	Content   string       `json:"content,omitempty"`
+	Frames    []*ViewFrame `json:"frames,omitempty"`
+}
+
+// viewRequest message sent by a viewer
+type viewRequest struct {
+	Type   string `json:"type"`
+	Format string `json:"format"`
+}
+
+// ParseRenderFormat returns the render format, an empty value is RenderText
+func ParseRenderFormat(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return RenderText, nil
+	}
+	for _, f := range RenderFormats {
+		if f == value {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("invalid format %q, expected %s", value, strings.Join(RenderFormats, ", "))
+}
+
+// RenderPayload renders a chunk of traffic found at offset of the recorded traffic
+func RenderPayload(format string, data []byte, offset int64) string {
+	switch format {
+	case RenderHex:
+		return hexDump(data, offset)
+	case RenderBase64:
+		return base64.StdEncoding.EncodeToString(data) + "\n"
+	}
+	return string(data)
+}
+
+// hexDump returns the hex dump of data, the offsets start at offset. The layout is the one of encoding/hex.Dump.
+func hexDump(data []byte, offset int64) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		sb.WriteString(fmt.Sprintf("%08x  ", offset+int64(i)))
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				sb.WriteString(fmt.Sprintf("%02x ", line[j]))
+			} else {
+				sb.WriteString("   ")
+			}
+			if j == 7 {
+				sb.WriteString(" ")
+			}
+		}
+
+		sb.WriteString(" |")
+		for _, c := range line {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			sb.WriteByte(c)
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
+
+// WriteRendered renders the traffic read from r to w a chunk at a time
+func WriteRendered(w io.Writer, format string, r io.Reader) error {
+	if format == RenderText {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	buf := make([]byte, renderChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			_, werr := io.WriteString(w, RenderPayload(format, buf[:n], offset))
+			if werr != nil {
+				return werr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeHistoryFramesLocked sends the recorded traffic of the session to fn as frames rendered in format. Forwarded
+// sessions have a marker frame each time the direction of the traffic changes, udp sessions have one before each
+// datagram. s.mu must be held so no traffic is recorded while the history is read, see Session.Watch.
+func (s *Session) writeHistoryFramesLocked(format string, fn func(frame *ViewFrame) error) error {
+	upstream, protocol := s.Upstream, s.Protocol
+
+	var offset int64
+	if (upstream == "" && protocol != UDP) || !BlobExists(s.FramesFile) {
+		historyFile, err := store.Blobs().Open(s.SaveFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = historyFile.Close()
+		}()
+
+		buf := make([]byte, renderChunkSize)
+		for {
+			n, err := io.ReadFull(historyFile, buf)
+			if n > 0 {
+				ferr := fn(&ViewFrame{Type: FrameData, Offset: offset, Content: RenderPayload(format, buf[:n], offset)})
+				if ferr != nil {
+					return ferr
+				}
+				offset += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	first := true
+	var last Direction
+	return WalkFrames(s.FramesFile, func(frame *Frame) error {
+		var marker []byte
+		switch {
+		case protocol == UDP:
+			marker = datagramMarker(frame.Time, len(frame.Data))
+		case first || last != frame.Direction:
+			marker = directionMarker(frame.Time, frame.Direction)
+		}
+		if marker != nil {
+			err := fn(markerFrame(frame.Time, frame.Direction, offset, marker))
+			if err != nil {
+				return err
+			}
+		}
+		first = false
+		last = frame.Direction
+
+		err := fn(&ViewFrame{
+			Type:      FrameData,
+			Direction: frame.Direction.String(),
+			Time:      frame.Time.UnixMilli(),
+			Offset:    offset,
+			Content:   RenderPayload(format, frame.Data, offset),
+		})
+		offset += int64(len(frame.Data))
+		return err
+	})
+}
+
+func markerFrame(t time.Time, dir Direction, offset int64, marker []byte) *ViewFrame {
+	return &ViewFrame{
+		Type:      FrameMarker,
+		Direction: dir.String(),
+		Time:      t.UnixMilli(),
+		Offset:    offset,
+		Content:   string(marker),
+	}
+}
+
+// broadcastView sends recorded traffic to the viewers, rendered once for each format in use. A marker is sent before
+// the traffic if it is set.
+func broadcastView(viewers map[string][]*melody.Session, t time.Time, dir Direction, pay []byte, offset int64, marker []byte) {
+	for format, list := range viewers {
+		if marker != nil {
+			sendFrame(list, markerFrame(t, dir, offset, marker))
+		}
+		sendFrame(list, &ViewFrame{
+			Type:      FrameData,
+			Direction: dir.String(),
+			Time:      t.UnixMilli(),
+			Offset:    offset,
+			Content:   RenderPayload(format, pay, offset),
+		})
+	}
+}
+
+func sendFrame(viewers []*melody.Session, frame *ViewFrame) {
+	msg, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	_ = m.BroadcastMultiple(msg, viewers)
+}
+
+// writeFrame sends a frame to a single viewer
+func writeFrame(viewer *melody.Session, frame *ViewFrame) error {
+	msg, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return viewer.Write(msg)
+}
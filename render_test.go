@@ -0,0 +1,72 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchSendsLongHistory(t *testing.T) {
+	setupTestServer(t)
+	routerURL := serveTestRouter(t)
+
+	s, err := createSession("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetProtocol(UDP)
+
+	// every datagram is a marker and a data frame, more than the 256 messages buffered for a viewer
+	const datagrams = 300
+	for i := 0; i < datagrams; i++ {
+		s.Record(Inbound, []byte(fmt.Sprintf("datagram %d", i)))
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(routerURL, "http") + "/v/" + s.Key + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var history ViewFrame
+	err = conn.ReadJSON(&history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Type != FrameHistory {
+		t.Fatalf("first frame is %q, want %q", history.Type, FrameHistory)
+	}
+	if len(history.Frames) != 2*datagrams {
+		t.Fatalf("history has %d frames, want %d", len(history.Frames), 2*datagrams)
+	}
+	if last := history.Frames[len(history.Frames)-1]; last.Content != fmt.Sprintf("datagram %d", datagrams-1) {
+		t.Errorf("last frame %q", last.Content)
+	}
+
+	// the viewer is registered once the history is sent
+	for len(s.ViewerList()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Record(Inbound, []byte("live"))
+	var marker, data ViewFrame
+	err = conn.ReadJSON(&marker)
+	if err == nil {
+		err = conn.ReadJSON(&data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker.Type != FrameMarker || data.Type != FrameData || data.Content != "live" {
+		t.Errorf("live frames %+v %+v", marker, data)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ReplayOptions struct to store the settings used to replay a session
+type ReplayOptions struct {
+	Target string        `json:"to"`
+	Timing bool          `json:"timing"`
+	Wait   time.Duration `json:"-"`
+}
+
+// ReplaySession sends the inbound traffic of a recorded tcp session to the target and records the conversation as a new
+// session linked to the original. If opts.Timing is set the original delay between chunks is honored. Once all data is
+// sent the response of the target is read until it closes the connection or is idle for opts.Wait.
+func ReplaySession(src *Session, opts *ReplayOptions) (*Session, error) {
+	protocol := src.ProtocolType()
+	if protocol == HTTP {
+		return nil, fmt.Errorf("session %s is a http session, use resend", src.Key)
+	}
+	if protocol == UDP {
+		return nil, fmt.Errorf("session %s is a udp session, replay sends tcp streams", src.Key)
+	}
+
+	if opts.Target == "" {
+		return nil, fmt.Errorf("replay target not set")
+	}
+
+	if opts.Wait <= 0 {
+		opts.Wait = 2 * time.Second
+	}
+
+	frames, err := replayFrames(src)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := net.DialTimeout("tcp", opts.Target, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	var ip string
+	if addr, ok := target.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	} else {
+		ip = target.LocalAddr().String()
+	}
+
+	session, err := createSession(ip)
+	if err != nil {
+		return nil, err
+	}
+	session.SetUpstream(opts.Target)
+	session.mu.Lock()
+	session.ReplayOf = src.Key
+	session.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			_ = target.SetReadDeadline(time.Now().Add(opts.Wait))
+			n, err := target.Read(buf)
+			if n > 0 {
+				if session.Record(Outbound, buf[:n]) >= int64(maxSessionSize) {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var last time.Duration
+	for _, frame := range frames {
+		if opts.Timing && frame.Elapsed > last {
+			time.Sleep(frame.Elapsed - last)
+		}
+		last = frame.Elapsed
+
+		session.Record(Inbound, frame.Data)
+		_, err = target.Write(frame.Data)
+		if err != nil {
+			fmt.Printf("Replay %s to %s write error: %v\n", src.Key, opts.Target, err)
+			break
+		}
+	}
+
+	if tc, ok := target.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	}
+	<-done
+
+	deactivateSession(session)
+
+	src.mu.Lock()
+	src.Replays = append(src.Replays, session.Key)
+	src.mu.Unlock()
+	_ = StoreSession(src)
+	Broadcast(SessionUpdated, src.ToApiSession())
+
+	return session, nil
+}
+
+// replayFrames returns the inbound chunks of a session, from the frames file if one exists or the whole save file.
+func replayFrames(src *Session) ([]*Frame, error) {
+	if BlobExists(src.FramesFile) {
+		frames, err := src.Frames(true)
+		if err != nil {
+			return nil, err
+		}
+
+		inbound := make([]*Frame, 0, len(frames))
+		for _, frame := range frames {
+			if frame.Direction == Inbound {
+				inbound = append(inbound, frame)
+			}
+		}
+		return inbound, nil
+	}
+
+	f, err := store.Blobs().Open(src.SaveFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return []*Frame{{Time: src.StartTime, Direction: Inbound, Size: len(data), Data: data}}, nil
+}
+
+// runReplayCommand implements `dumpr replay <key> --to host:port`
+func runReplayCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dumpr replay <key> --to host:port [--timing] [--replayWait 2s]")
+	}
+
+	src, err := LoadSession(args[0])
+	if err != nil {
+		return fmt.Errorf("unable to load session %s: %v", args[0], err)
+	}
+	if src == nil {
+		return fmt.Errorf("session %s not found", args[0])
+	}
+
+	wait, err := time.ParseDuration(*replayWait)
+	if err != nil {
+		return fmt.Errorf("invalid field: replayWait - %v", err)
+	}
+
+	session, err := ReplaySession(src, &ReplayOptions{Target: *replayTo, Timing: *replayTiming, Wait: wait})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replayed %s to %s, sent: %d bytes received: %d bytes\n", src.Key, *replayTo, session.BytesIn, session.BytesOut)
+	fmt.Printf("view at %s/v/%s\n", *publicUrl, session.Key)
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// hopHeaders headers that only apply to the original connection and are not resent
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ErrResendRedacted the captured request has masked values that would be sent as [REDACTED]
+var ErrResendRedacted = errors.New("request was redacted")
+
+// ResendOptions struct to store the settings used to resend a http session. A request with masked values is only
+// resent if Headers replaces every masked header, or AllowRedacted is set.
+type ResendOptions struct {
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers"`
+	AllowRedacted bool              `json:"allowRedacted"`
+}
+
+// ResendResult struct to store the outcome of resending a http session
+type ResendResult struct {
+	Time       string      `json:"time"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header"`
+	StatusCode int         `json:"statusCode"`
+	Error      string      `json:"error,omitempty"`
+	File       string      `json:"file"`
+	// SentRedacted the masked values of the captured request that were sent as [REDACTED]
+	SentRedacted []string `json:"sentRedacted,omitempty"`
+	// Redacted what was masked in the response before it was stored
+	Redacted []string          `json:"redacted,omitempty"`
+	Response *HTTPResponseJSON `json:"response,omitempty"`
+}
+
+// NewResendRequest rebuilds the captured request of a http session, the path and query of the original request are
+// appended to opts.URL and opts.Headers replace the captured headers.
+func NewResendRequest(request *HTTPRequestJSON, opts *ResendOptions) (*http.Request, error) {
+	uri := request.RequestURI
+	if u, err := url.ParseRequestURI(uri); err == nil && u.IsAbs() {
+		// a request sent to a proxy, only its path and query are resent
+		uri = u.RequestURI()
+	}
+	target := strings.TrimSuffix(opts.URL, "/") + uri
+	req, err := http.NewRequest(request.Method, target, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range request.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+
+	for k, v := range opts.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		if v == "" {
+			req.Header.Del(k)
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// unreplacedRedactions returns the masked values of the request that opts.Headers does not replace
+func unreplacedRedactions(request *HTTPRequestJSON, opts *ResendOptions) []string {
+	replaced := make(map[string]bool, len(opts.Headers))
+	for k := range opts.Headers {
+		replaced["header:"+http.CanonicalHeaderKey(k)] = true
+	}
+
+	var list []string
+	for _, v := range request.Redacted {
+		if !replaced[v] {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// ResendSession sends the captured request of a http session to opts.URL and stores the response next to the session.
+// The response is redacted like a captured request before it is stored. A request with masked values that opts does not
+// replace is refused with ErrResendRedacted unless opts.AllowRedacted is set.
+func ResendSession(s *Session, opts *ResendOptions) (*ResendResult, error) {
+	s.mu.RLock()
+	protocol, request := s.Protocol, s.HTTPSession
+	s.mu.RUnlock()
+
+	if protocol != HTTP || request == nil {
+		return nil, fmt.Errorf("session %s is not a http session", s.Key)
+	}
+
+	if opts.URL == "" {
+		return nil, fmt.Errorf("resend url not set")
+	}
+
+	redacted := unreplacedRedactions(request, opts)
+	if len(redacted) > 0 && !opts.AllowRedacted {
+		return nil, fmt.Errorf("%w, %s would be sent as %s, set the masked headers or allowRedacted", ErrResendRedacted, strings.Join(redacted, ", "), RedactedValue)
+	}
+
+	req, err := NewResendRequest(request, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ResendResult{
+		Time:         time.Now().UTC().Format(JavascriptISOString),
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		Header:       redactor.redactHeaders(req.Header, make(map[string]bool)),
+		SentRedacted: redacted,
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		body, err := io.ReadAll(io.LimitReader(res.Body, int64(maxSessionSize)))
+		_ = res.Body.Close()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.StatusCode = res.StatusCode
+		result.Response = NewHTTPResponseJSON(res, body)
+		result.Redacted = redactor.RedactResponse(result.Response)
+	}
+
+	s.mu.Lock()
+	result.File = fmt.Sprintf("%s/%s.resend-%d.json", filepath.Dir(s.SaveFile), s.Key, len(s.Resends)+1)
+	summary := *result
+	summary.Response = nil
+	s.Resends = append(s.Resends, &summary)
+	s.mu.Unlock()
+
+	dump, _ := json.MarshalIndent(result, "", "    ")
+	err = WriteBlob(result.File, dump)
+	if err != nil {
+		return result, err
+	}
+
+	_ = StoreSession(s)
+	Broadcast(SessionUpdated, s.ToApiSession())
+	return result, nil
+}
+
+// LoadResendResult load a stored resend result of a session
+func LoadResendResult(s *Session, index int) (*ResendResult, error) {
+	s.mu.RLock()
+	if index < 1 || index > len(s.Resends) {
+		s.mu.RUnlock()
+		return nil, fmt.Errorf("resend %d not found", index)
+	}
+	file := s.Resends[index-1].File
+	s.mu.RUnlock()
+
+	raw, err := ReadBlob(file)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ResendResult{}
+	err = json.Unmarshal(raw, result)
+	return result, err
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResendRedactedRequest(t *testing.T) {
+	setupTestServer(t)
+	r, err := NewRedactor([]string{"Authorization", "Set-Cookie"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor = r
+	t.Cleanup(func() {
+		redactor = &Redactor{headers: make(map[string]bool)}
+	})
+
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = req.Header.Get("Authorization")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+	}))
+	defer upstream.Close()
+
+	s, err := createSession("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &HTTPRequestJSON{
+		Method:     http.MethodGet,
+		RequestURI: "/login",
+		Header:     map[string][]string{"Authorization": {"Bearer captured"}},
+	}
+	redactor.RedactRequest(request)
+	s.mu.Lock()
+	s.Protocol = HTTP
+	s.HTTPSession = request
+	s.mu.Unlock()
+	deactivateSession(s)
+
+	_, err = ResendSession(s, &ResendOptions{URL: upstream.URL})
+	if !errors.Is(err, ErrResendRedacted) {
+		t.Fatalf("err = %v, want ErrResendRedacted", err)
+	}
+
+	result, err := ResendSession(s, &ResendOptions{URL: upstream.URL, Headers: map[string]string{"authorization": "Bearer fresh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer fresh" {
+		t.Errorf("sent authorization %q, want the replaced value", authorization)
+	}
+	if len(result.SentRedacted) != 0 {
+		t.Errorf("sentRedacted = %v, want none", result.SentRedacted)
+	}
+	if got := result.Header.Get("Authorization"); got != RedactedValue {
+		t.Errorf("stored authorization %q, want %s", got, RedactedValue)
+	}
+
+	stored, err := LoadResendResult(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := http.Header(stored.Response.Header).Get("Set-Cookie"); got != RedactedValue {
+		t.Errorf("stored set-cookie %q, want %s", got, RedactedValue)
+	}
+}
@@ -81,6 +81,7 @@ func (r *AutoResponses) Update(payload *AutoResponse) error {
 	response.ContentType = payload.ContentType
 	response.Response = payload.Response
 	response.ResponseHeaders = payload.ResponseHeaders
+	response.Version++
 	response.Init()
 	r.m[response.Name] = response
 	return r.Save()
@@ -118,6 +119,7 @@ type AutoResponse struct {
 	ContentType     string            `yaml:"content_type" json:"content_type"`
 	Response        string            `yaml:"response" json:"response"`
 	ResponseHeaders map[string]string `yaml:"responseHeaders" json:"response_headers"`
+	Version         int               `yaml:"version" json:"version"`
 	pathRegex       *regexp.Regexp
 }
 
@@ -184,6 +186,10 @@ func (r *AutoResponse) Init() {
 	if r.ResponseHeaders == nil {
 		r.ResponseHeaders = make(map[string]string)
 	}
+
+	if r.Version == 0 {
+		r.Version = 1
+	}
 }
 
 // Find attempts to find a match if the AutoResponse to the http.Request
@@ -193,20 +199,25 @@ func (r *AutoResponses) Find(req *http.Request) *AutoResponse {
 	}
 
 	for _, r := range r.l {
-		matchedMethod, _ := regexp.MatchString(r.Method, req.Method)
-		matchedURI := false
-		if r.pathRegex != nil {
-			matchedURI = r.pathRegex.MatchString(req.RequestURI)
-		}
-
-		//fmt.Printf("req.Method: %s req.RequestURI: %s Method: %s Path: %s matchedMethod: %v matchedURI: %v\n", req.Method, req.RequestURI, r.Method, r.Path, matchedMethod, matchedURI)
-		if matchedMethod && matchedURI {
+		if r.Matches(req) {
 			return r
 		}
 	}
 	return nil
 }
 
+// Matches returns true if the method and path of the http.Request match the AutoResponse
+func (r *AutoResponse) Matches(req *http.Request) bool {
+	matchedMethod, _ := regexp.MatchString(r.Method, req.Method)
+	matchedURI := false
+	if r.pathRegex != nil {
+		matchedURI = r.pathRegex.MatchString(req.RequestURI)
+	}
+
+	//fmt.Printf("req.Method: %s req.RequestURI: %s Method: %s Path: %s matchedMethod: %v matchedURI: %v\n", req.Method, req.RequestURI, r.Method, r.Path, matchedMethod, matchedURI)
+	return matchedMethod && matchedURI
+}
+
 // CreateDefaultRules create slice of default rules to populate bucket with on first run
 func CreateDefaultRules() []*AutoResponse {
 
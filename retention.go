@@ -0,0 +1,230 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reaperInterval how often the reaper evaluates the retention policy
+const reaperInterval = time.Minute
+
+// RetentionPolicy rules evaluated by the session reaper. Active and pinned sessions are never purged, they still count
+// towards the session and disk limits.
+//
+//	ttl          sessions older than the ttl of their bin, else their protocol, else --purgeOlderThan are purged.
+//	maxSessions  the oldest sessions are purged while there are more sessions.
+//	maxDiskUsage the oldest sessions are purged while the session files use more bytes.
+type RetentionPolicy struct {
+	Default      time.Duration
+	Protocols    map[Protocol]time.Duration
+	MaxSessions  int
+	MaxDiskUsage int64
+}
+
+// RetentionRun result of a reaper run
+type RetentionRun struct {
+	Time    time.Time      `json:"time"`
+	Purged  int            `json:"purged"`
+	Reasons map[string]int `json:"reasons"`
+}
+
+// RetentionStatus state of the retention policy returned by /api/retention
+type RetentionStatus struct {
+	PurgeOlderThan        string            `json:"purgeOlderThan"`
+	Protocols             map[string]string `json:"protocols"`
+	Bins                  map[string]string `json:"bins"`
+	MaxSessions           int               `json:"maxSessions"`
+	MaxDiskUsage          int64             `json:"maxDiskUsage"`
+	MaxDiskUsageFormatted string            `json:"maxDiskUsageFormatted"`
+	Sessions              int               `json:"sessions"`
+	Active                int               `json:"active"`
+	Pinned                int               `json:"pinned"`
+	DiskUsage             int64             `json:"diskUsage"`
+	DiskUsageFormatted    string            `json:"diskUsageFormatted"`
+	Interval              string            `json:"interval"`
+	LastRun               *RetentionRun     `json:"lastRun,omitempty"`
+	TotalPurged           int               `json:"totalPurged"`
+}
+
+var (
+	retention = &RetentionPolicy{Protocols: make(map[Protocol]time.Duration)}
+
+	retentionMu    sync.Mutex
+	lastRetention  *RetentionRun
+	retentionTotal int
+)
+
+// InitializeRetention builds the retention policy from the --purgeOlderThan, --protocolRetention, --maxSessions and
+// --maxDiskUsage options
+func InitializeRetention() error {
+	policy := &RetentionPolicy{
+		Default:     purgeOlderThan.Duration(),
+		Protocols:   make(map[Protocol]time.Duration),
+		MaxSessions: *maxSessions,
+	}
+
+	for _, v := range *protocolRetention {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("invalid protocol retention %q, expected protocol=duration", v)
+		}
+
+		protocol, err := ParseProtocol(name)
+		if err != nil {
+			return fmt.Errorf("invalid protocol retention %q, %v", v, err)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid protocol retention %q: %v", v, err)
+		}
+		policy.Protocols[protocol] = ttl
+	}
+
+	if *maxDiskUsage != "" && *maxDiskUsage != "0" {
+		size, err := humanize.ParseBytes(*maxDiskUsage)
+		if err != nil {
+			return fmt.Errorf("invalid max disk usage %q: %v", *maxDiskUsage, err)
+		}
+		policy.MaxDiskUsage = int64(size)
+	}
+
+	retention = policy
+	return nil
+}
+
+// TTL returns how long the session is kept, 0 keeps the session until a session or disk limit is reached
+func (p *RetentionPolicy) TTL(s *Session) time.Duration {
+	if bin, ok := Bins.Get(s.BinName()); ok && bin.RetentionDuration() > 0 {
+		return bin.RetentionDuration()
+	}
+
+	s.mu.RLock()
+	protocol := s.Protocol
+	s.mu.RUnlock()
+	if ttl, ok := p.Protocols[protocol]; ok {
+		return ttl
+	}
+	return p.Default
+}
+
+// Evaluate returns the sessions to purge and the rule that selected each one
+func (p *RetentionPolicy) Evaluate(sessions []*Session, now time.Time) map[*Session]string {
+	purge := make(map[*Session]string)
+
+	sorted := append([]*Session(nil), sessions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].StartTime.Before(sorted[j].StartTime)
+	})
+
+	candidates := make([]*Session, 0, len(sorted))
+	for _, s := range sorted {
+		if s.IsActive() || s.IsPinned() {
+			continue
+		}
+
+		ttl := p.TTL(s)
+		if ttl > 0 && now.After(s.StartTime.Add(ttl)) {
+			purge[s] = "ttl"
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+
+	if p.MaxSessions > 0 {
+		count := len(sorted) - len(purge)
+		for i := 0; count > p.MaxSessions && i < len(candidates); i++ {
+			purge[candidates[i]] = "maxSessions"
+			count--
+		}
+	}
+
+	if p.MaxDiskUsage > 0 {
+		var usage int64
+		for _, s := range sorted {
+			if _, ok := purge[s]; !ok {
+				usage += s.DiskUsage()
+			}
+		}
+
+		for _, s := range candidates {
+			if usage <= p.MaxDiskUsage {
+				break
+			}
+			if _, ok := purge[s]; ok {
+				continue
+			}
+			purge[s] = "maxDiskUsage"
+			usage -= s.DiskUsage()
+		}
+	}
+	return purge
+}
+
+// ApplyRetention purges the sessions selected by the retention policy
+func ApplyRetention(now time.Time) *RetentionRun {
+	run := &RetentionRun{Time: now, Reasons: make(map[string]int)}
+	for s, reason := range retention.Evaluate(Sessions.List(), now) {
+		PurgeSession(s)
+		run.Purged++
+		run.Reasons[reason]++
+	}
+
+	retentionMu.Lock()
+	lastRetention = run
+	retentionTotal += run.Purged
+	retentionMu.Unlock()
+
+	if run.Purged > 0 {
+		fmt.Printf("Retention purged %d sessions %v\n", run.Purged, run.Reasons)
+	}
+	return run
+}
+
+// GetRetentionStatus returns the retention policy, the current usage and the result of the last reaper run
+func GetRetentionStatus() *RetentionStatus {
+	status := &RetentionStatus{
+		PurgeOlderThan:        retention.Default.String(),
+		Protocols:             make(map[string]string),
+		Bins:                  make(map[string]string),
+		MaxSessions:           retention.MaxSessions,
+		MaxDiskUsage:          retention.MaxDiskUsage,
+		MaxDiskUsageFormatted: humanize.Bytes(uint64(retention.MaxDiskUsage)),
+		Interval:              reaperInterval.String(),
+	}
+
+	for protocol, ttl := range retention.Protocols {
+		status.Protocols[protocol.String()] = ttl.String()
+	}
+	for _, b := range Bins.List() {
+		if b.RetentionDuration() > 0 {
+			status.Bins[b.Name] = b.RetentionDuration().String()
+		}
+	}
+
+	for _, s := range Sessions.List() {
+		status.Sessions++
+		if s.IsActive() {
+			status.Active++
+		}
+		if s.IsPinned() {
+			status.Pinned++
+		}
+		status.DiskUsage += s.DiskUsage()
+	}
+	status.DiskUsageFormatted = humanize.Bytes(uint64(status.DiskUsage))
+
+	retentionMu.Lock()
+	status.LastRun = lastRetention
+	status.TotalPurged = retentionTotal
+	retentionMu.Unlock()
+	return status
+}
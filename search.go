@@ -0,0 +1,345 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSearchPageSize sessions returned per page when pageSize is not set
+	defaultSearchPageSize = 50
+
+	// maxSearchPageSize upper bound of the pageSize of a search
+	maxSearchPageSize = 500
+
+	// maxSearchCaptureBytes bytes of the recorded traffic of a tcp session the body filter looks at
+	maxSearchCaptureBytes = 1 << 20
+
+	// maxSearchScanBytes recorded traffic a search reads for the body filter, older tcp sessions are not searched once
+	// it is reached
+	maxSearchScanBytes = 64 << 20
+)
+
+// SearchQuery filters of /api/search, empty fields match every session
+type SearchQuery struct {
+	IP          string
+	Protocol    string
+	Method      string
+	Rule        string
+	Bin         string
+	Labels      []string
+	HeaderName  string
+	HeaderValue string
+	Body        string
+	Path        *regexp.Regexp
+	Since       time.Time
+	Until       time.Time
+	MinSize     int64
+	MaxSize     int64
+	Page        int
+	PageSize    int
+	// scanned recorded traffic read by the body filter, truncated is set if traffic was not searched
+	scanned   int64
+	truncated bool
+}
+
+// SearchResult a page of the sessions matching a SearchQuery, newest first
+type SearchResult struct {
+	Result   string `json:"result"`
+	Code     string `json:"code"`
+	Total    int    `json:"total"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	Pages    int    `json:"pages"`
+	// Truncated the body filter did not search all the recorded tcp traffic, matches may be missing
+	Truncated bool          `json:"truncated,omitempty"`
+	Sessions  []*ApiSession `json:"sessions"`
+}
+
+// indexTerms returns the terms the session is indexed under in the SessionStore, the exact match filters of a search
+func indexTerms(s *Session) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := []string{
+		"ip=" + s.IP,
+		"protocol=" + s.Protocol.String(),
+	}
+	if s.Bin != "" {
+		terms = append(terms, "bin="+s.Bin)
+	}
+	if s.HTTPMethod != "" {
+		terms = append(terms, "method="+strings.ToLower(s.HTTPMethod))
+	}
+	if s.HandledByRule != "" {
+		terms = append(terms, "rule="+s.HandledByRule)
+	}
+	for _, l := range s.Labels {
+		terms = append(terms, "label="+strings.ToLower(l))
+	}
+	for name := range s.headers() {
+		terms = append(terms, "header="+strings.ToLower(name))
+	}
+	return terms
+}
+
+// ParseSearchQuery returns the SearchQuery of the query values ip, protocol (a Protocol name), method, rule, bin, label
+// (comma separated, all must match), header (name or name:value), body, path (regular expression), since and until
+// (RFC3339 time or duration before now), minSize and maxSize (bytes, 10KB), page and pageSize.
+func ParseSearchQuery(query url.Values) (*SearchQuery, error) {
+	q := &SearchQuery{
+		IP:       strings.TrimSpace(query.Get("ip")),
+		Protocol: strings.ToLower(strings.TrimSpace(query.Get("protocol"))),
+		Method:   strings.ToLower(strings.TrimSpace(query.Get("method"))),
+		Rule:     strings.TrimSpace(query.Get("rule")),
+		Bin:      strings.ToLower(strings.TrimSpace(query.Get("bin"))),
+		Body:     query.Get("body"),
+		MinSize:  -1,
+		MaxSize:  -1,
+		Page:     1,
+		PageSize: defaultSearchPageSize,
+	}
+
+	if q.Protocol != "" {
+		if _, err := ParseProtocol(q.Protocol); err != nil {
+			return nil, fmt.Errorf("invalid protocol, %v", err)
+		}
+	}
+
+	for _, l := range strings.Split(query.Get("label"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			q.Labels = append(q.Labels, strings.ToLower(l))
+		}
+	}
+
+	if header := query.Get("header"); header != "" {
+		name, value, _ := strings.Cut(header, ":")
+		q.HeaderName = strings.ToLower(strings.TrimSpace(name))
+		q.HeaderValue = strings.ToLower(strings.TrimSpace(value))
+		if q.HeaderName == "" {
+			return nil, fmt.Errorf("invalid header %q, expected name or name:value", header)
+		}
+	}
+
+	var err error
+	if query.Get("path") != "" {
+		q.Path, err = regexp.Compile(query.Get("path"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path: %v", err)
+		}
+	}
+
+	q.Since, err = parseTimeParam(query.Get("since"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid since: %v", err)
+	}
+	q.Until, err = parseTimeParam(query.Get("until"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid until: %v", err)
+	}
+
+	q.MinSize, err = parseSizeParam(query.Get("minSize"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid minSize: %v", err)
+	}
+	q.MaxSize, err = parseSizeParam(query.Get("maxSize"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxSize: %v", err)
+	}
+
+	if v := query.Get("page"); v != "" {
+		q.Page, err = strconv.Atoi(v)
+		if err != nil || q.Page < 1 {
+			return nil, fmt.Errorf("invalid page %q", v)
+		}
+	}
+	if v := query.Get("pageSize"); v != "" {
+		q.PageSize, err = strconv.Atoi(v)
+		if err != nil || q.PageSize < 1 || q.PageSize > maxSearchPageSize {
+			return nil, fmt.Errorf("invalid pageSize %q, expected 1 to %d", v, maxSearchPageSize)
+		}
+	}
+	return q, nil
+}
+
+// parseSizeParam parses a size in bytes, an empty value returns -1
+func parseSizeParam(value string) (int64, error) {
+	if value == "" {
+		return -1, nil
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// terms returns the index terms of the exact match filters
+func (q *SearchQuery) terms() []string {
+	terms := make([]string, 0)
+	if q.IP != "" {
+		terms = append(terms, "ip="+q.IP)
+	}
+	if q.Protocol != "" {
+		terms = append(terms, "protocol="+q.Protocol)
+	}
+	if q.Method != "" {
+		terms = append(terms, "method="+q.Method)
+	}
+	if q.Rule != "" {
+		terms = append(terms, "rule="+q.Rule)
+	}
+	if q.Bin != "" {
+		terms = append(terms, "bin="+q.Bin)
+	}
+	for _, l := range q.Labels {
+		terms = append(terms, "label="+l)
+	}
+	if q.HeaderName != "" {
+		terms = append(terms, "header="+q.HeaderName)
+	}
+	return terms
+}
+
+// Match returns true if the session passes the filters that are not in the index, the cheap checks run first
+func (q *SearchQuery) Match(s *Session) bool {
+	switch {
+	case !q.Since.IsZero() && s.StartTime.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && s.StartTime.After(q.Until):
+		return false
+	}
+
+	s.mu.RLock()
+	path := s.HTTPPath
+	request := s.HTTPSession
+	message := s.MailSession
+	header := s.headers()
+	s.mu.RUnlock()
+
+	if q.Path != nil && !q.Path.MatchString(path) {
+		return false
+	}
+
+	if q.HeaderValue != "" {
+		if !headerContains(header, q.HeaderName, q.HeaderValue) {
+			return false
+		}
+	}
+
+	if q.MinSize >= 0 || q.MaxSize >= 0 {
+		size := s.Size().Val
+		if (q.MinSize >= 0 && size < q.MinSize) || (q.MaxSize >= 0 && size > q.MaxSize) {
+			return false
+		}
+	}
+
+	if q.Body != "" {
+		var body []byte
+		switch {
+		case request != nil:
+			body = request.Body
+		case message != nil:
+			body = []byte(message.Text + message.HTML)
+		default:
+			// tcp sessions keep the captured traffic in the raw file, the start of it is searched within the scan budget
+			body = q.readCapture(s.SaveFile)
+		}
+		if !bytes.Contains(body, []byte(q.Body)) {
+			return false
+		}
+	}
+	return true
+}
+
+// readCapture returns the first maxSearchCaptureBytes of the recorded traffic, nothing once the search read
+// maxSearchScanBytes. q.truncated is set if traffic is skipped.
+func (q *SearchQuery) readCapture(name string) []byte {
+	if q.scanned >= maxSearchScanBytes {
+		q.truncated = true
+		return nil
+	}
+
+	r, err := store.Blobs().Open(name)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	body, _ := io.ReadAll(io.LimitReader(r, maxSearchCaptureBytes+1))
+	if len(body) > maxSearchCaptureBytes {
+		body = body[:maxSearchCaptureBytes]
+		q.truncated = true
+	}
+	q.scanned += int64(len(body))
+	return body
+}
+
+// headers returns the headers of the http request or of the mail of the session, s.mu must be held
+func (s *Session) headers() map[string][]string {
+	switch {
+	case s.HTTPSession != nil:
+		return s.HTTPSession.Header
+	case s.MailSession != nil:
+		return s.MailSession.Header
+	}
+	return nil
+}
+
+// headerContains returns true if a value of the named header contains value, both are lower case
+func headerContains(header map[string][]string, name, value string) bool {
+	for k, values := range header {
+		if strings.ToLower(k) != name {
+			continue
+		}
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Search returns the page of the sessions matching the query, newest first. The exact match filters are answered by
+// the index of the SessionStore, the remaining filters are checked on the candidates.
+func Search(q *SearchQuery) *SearchResult {
+	candidates := Sessions.Lookup(q.terms())
+
+	matches := make([]*Session, 0)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if q.Match(candidates[i]) {
+			matches = append(matches, candidates[i])
+		}
+	}
+
+	result := &SearchResult{
+		Result:    "success",
+		Code:      "SUCCESS",
+		Total:     len(matches),
+		Page:      q.Page,
+		PageSize:  q.PageSize,
+		Pages:     (len(matches) + q.PageSize - 1) / q.PageSize,
+		Truncated: q.truncated,
+		Sessions:  make([]*ApiSession, 0),
+	}
+
+	start := (q.Page - 1) * q.PageSize
+	for i := start; i < len(matches) && i < start+q.PageSize; i++ {
+		result.Sessions = append(result.Sessions, matches[i].ToApiSession())
+	}
+	return result
+}
@@ -7,26 +7,108 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
+	"golang.org/x/net/http2"
 	"io"
 	"net"
 	"net/http"
-	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// SpawnTCPListener spawn a tcp listener on the host, port will exit if unable to open port.
-func SpawnTCPListener(host string, port int) error {
-	fmt.Printf("spawn: %s:%d\n", host, port)
+// ListenerConfig struct to store the settings of a tcp listener
+type ListenerConfig struct {
+	Host    string
+	Port    int
+	TLS     bool
+	Forward string
+
+	// ProxyProtocol a PROXY protocol header sent by a trusted proxy at the start of a connection gives the client address
+	ProxyProtocol bool
+
+	// SMTP connections are served by the SMTP decoder without sniffing, the server speaks first
+	SMTP bool
+
+	// UDP the port is a udp port, datagrams are grouped by source address, see SpawnUDPListener
+	UDP bool
+}
+
+// ParseListenerConfig parse a --listen value in the form port[,tls][,proxy][,smtp][,forward=host:port] or port,udp
+func ParseListenerConfig(host, value string) (*ListenerConfig, error) {
+	parts := strings.Split(value, ",")
+	port, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener port %q: %v", parts[0], err)
+	}
+
+	config := &ListenerConfig{Host: host, Port: port}
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == "tls":
+			config.TLS = true
+		case opt == "proxy":
+			config.ProxyProtocol = true
+		case opt == "smtp":
+			config.SMTP = true
+		case opt == "udp":
+			config.UDP = true
+		case strings.HasPrefix(opt, "forward="):
+			config.Forward = strings.TrimPrefix(opt, "forward=")
+		default:
+			return nil, fmt.Errorf("invalid listener option %q", opt)
+		}
+	}
+
+	if config.UDP && (config.TLS || config.ProxyProtocol || config.SMTP || config.Forward != "") {
+		return nil, fmt.Errorf("invalid listener %q, udp can not be combined with other options", value)
+	}
+	return config, nil
+}
+
+// String return the human-readable form of ListenerConfig
+func (c *ListenerConfig) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s:%d", c.Host, c.Port))
+	if c.UDP {
+		sb.WriteString(" udp")
+	}
+	if c.TLS {
+		sb.WriteString(" tls")
+	}
+	if c.ProxyProtocol {
+		sb.WriteString(" proxy protocol")
+	}
+	if c.SMTP {
+		sb.WriteString(" smtp")
+	}
+	if c.Forward != "" {
+		sb.WriteString(fmt.Sprintf(" forward to %s", c.Forward))
+	}
+	return sb.String()
+}
+
+// SpawnTCPListener spawn a tcp listener for the config, will exit if unable to open port.
+func SpawnTCPListener(config *ListenerConfig) error {
+	fmt.Printf("spawn: %s\n", config)
 	// Listen for incoming connections.
-	listener := fmt.Sprintf("%s:%d", host, port)
+	listener := fmt.Sprintf("%s:%d", config.Host, config.Port)
 	l, err := net.Listen("tcp", listener)
 	if err != nil {
 		fmt.Println("Error listening:", err.Error())
 		return err
 	}
 
+	if config.TLS {
+		_, err = tlsServerConfig()
+		if err != nil {
+			fmt.Printf("Error loading tls certificate: %v\n", err)
+			_ = l.Close()
+			return err
+		}
+	}
+
 	go func() {
 		// Close the listener when the application closes.
 		defer func() {
@@ -34,7 +116,7 @@ func SpawnTCPListener(host string, port int) error {
 		}()
 		conns := clientConns(l)
 		for {
-			go handleConn(<-conns)
+			go handleConn(<-conns, config)
 		}
 	}()
 	return nil
@@ -60,7 +142,7 @@ func clientConns(listener net.Listener) chan net.Conn {
 	return ch
 }
 
-func handleConn(client net.Conn) {
+func handleConn(client net.Conn, config *ListenerConfig) {
 	var ip string
 	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
 		ip = addr.IP.String()
@@ -74,105 +156,175 @@ func handleConn(client net.Conn) {
 		return
 	}
 
-	buf := make([]byte, 255)
-	b := bufio.NewReader(client)
-	checkedForHTTP := false
-	sentHeader := false
-	fileSize := 0
-	for {
-		if !checkedForHTTP && b.Buffered() >= 0 {
-			//fmt.Printf("2: %d\n", b.Buffered())
-			pay, err := b.Peek(16)
-			if err == nil {
-				//fmt.Printf("len(pay: %d\n", len(pay))
-				isHTTPRequest, _ := regexp.Match("^(GET|POST|PUT|DELETE)\\s+.+", pay)
-				//fmt.Printf("isHTTPRequest: %v err: %v\n", isHTTPRequest, e)
-				if isHTTPRequest {
-					//fmt.Printf("3: %d\n", b.Buffered())
-					req, err := http.ReadRequest(b)
-					//fmt.Printf("4: %d\n", b.Buffered())
-					if err != nil {
-						break
-					}
-					session.InitializeHTTP(req)
-					checkedForHTTP = true
-
-					response := &http.Response{}
-					response.StatusCode = 200
-					response.Proto = "HTTP/1.1"
-					response.ProtoMajor = 1
-					response.ProtoMinor = 1
-					response.Request = req
-					response.Header = http.Header{}
-					response.Header["X-Session-Key"] = []string{session.Key}
-					url := fmt.Sprintf("%s/v/%s", *publicUrl, session.Key)
-					response.Header["X-Session-URL"] = []string{url}
-					url = fmt.Sprintf("%s/api/info/%s", *publicUrl, session.Key)
-					response.Header["X-Session-Info-URL"] = []string{url}
-					response.Header["Content-Type"] = []string{"application/json; charset=utf-8"}
-					s := time.Now().UTC().Format(http.TimeFormat)
-					response.Header["Date"] = []string{s}
-
-					autoResponse := autoResponders.Find(req)
-					if autoResponse != nil {
-						session.HandledByRule = autoResponse.Name
-					}
-
-					if autoResponse != nil {
-						response.StatusCode = autoResponse.StatusCode
-						response.Header["Content-Type"] = []string{autoResponse.ContentType}
-						response.Header["X-AutoResponder-Name"] = []string{autoResponse.Name}
-
-						if autoResponse.ResponseHeaders != nil {
-							for k, v := range autoResponse.ResponseHeaders {
-								response.Header[k] = []string{v}
-							}
-						}
-
-						payload := []byte(autoResponse.Response)
-						response.Body = io.NopCloser(bytes.NewReader(payload))
-						response.ContentLength = int64(len(payload))
-					} else {
-						sessionInfo := createNewSessionResponse(session)
-						dump, _ := json.MarshalIndent(sessionInfo, "", "    ")
-						response.Body = io.NopCloser(bytes.NewReader(dump))
-						response.ContentLength = int64(len(dump))
-					}
-
-					var b bytes.Buffer
-					w := bufio.NewWriter(&b)
-					_ = response.Write(w)
-					_ = w.Flush()
-					_, _ = client.Write(b.Bytes())
-				}
-			}
-		}
+	reader := bufio.NewReader(client)
+	if config.ProxyProtocol {
+		acceptProxyHeader(session, client, reader)
+	}
 
-		if checkedForHTTP {
-			break
-		}
+	if config.TLS {
+		// the certificate was loaded when the listener was spawned
+		tlsConfig, _ := tlsServerConfig()
+		tc := newTLSConn(&bufferedConn{Conn: client, r: reader}, tlsConfig)
+		client = tc
+		reader = bufio.NewReader(tc)
 
-		if !sentHeader {
-			Broadcast(SessionUpdated, session.ToApiSession())
-			_, _ = client.Write([]byte(fmt.Sprintf("view at %s/v/%s", *publicUrl, session.Key)))
-			sentHeader = true
+		session.SetProtocol(TLS)
+		info, err := tc.Info()
+		session.mu.Lock()
+		session.TLS = info
+		session.mu.Unlock()
+		if err != nil {
+			fmt.Printf("Session %s tls handshake failed: %v\n", session.Key, err)
+			deactivateSession(session)
+			_ = client.Close()
+			return
 		}
+	}
+
+	if config.Forward != "" {
+		forwardConn(session, &bufferedConn{Conn: client, r: reader}, config.Forward)
+		deactivateSession(session)
+		_ = client.Close()
+		return
+	}
+
+	sc := &StreamConn{Session: session, Conn: client, Reader: reader, Config: config}
+	if config.SMTP {
+		decodeSMTP(sc)
+	} else {
+		sc.Serve()
+	}
+
+	deactivateSession(session)
+	_ = client.Close()
+}
+
+// serveRaw records the stream as is until the client closes it or the max session size is reached, the client is sent
+// the url of the live view first
+func serveRaw(sc *StreamConn) {
+	session := sc.Session
+	Broadcast(SessionUpdated, session.ToApiSession())
+	_, _ = sc.Conn.Write([]byte(fmt.Sprintf("view at %s/v/%s", *publicUrl, session.Key)))
 
-		byteRead, err := b.Read(buf)
+	buf := make([]byte, 255)
+	fileSize := 0
+	for {
+		byteRead, err := sc.Reader.Read(buf)
 		if err != nil { // EOF, or worse
 			break
 		}
 		pay := buf[:byteRead]
 		fileSize += len(pay)
-		_, _ = session.outputFile.Write(pay)
-		_ = m.BroadcastMultiple(pay, session.Viewers)
+		session.Record(Inbound, pay)
 		if fileSize >= maxSessionSize {
 			fmt.Printf("Shuting down session: %s max session size reached: %d maxSessionSize: %d\n", session.Key, fileSize, maxSessionSize)
 			break
 		}
+	}
+}
+
+// httpKeepAliveTimeout how long a connection is held open waiting for the next request, and the time a client has to
+// send a request once it started it
+const httpKeepAliveTimeout = 2 * time.Minute
+
+// serveHTTPConn reads the http requests sent on a connection until the client closes it, asks for it to be closed or
+// stays idle. Each request is captured in its own http session linked to the connection session, pipelined requests
+// are answered in the order they were received.
+func serveHTTPConn(conn *Session, client net.Conn, b *bufio.Reader) {
+	for {
+		// the first request gets the same deadline, a client that never completes its headers is not held forever
+		_ = client.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout))
+		req, err := http.ReadRequest(b)
+		if err != nil {
+			return
+		}
+
+		session, res, err := captureHTTPRequest(conn, req)
+		if err != nil {
+			_, _ = client.Write([]byte(fmt.Sprintf("HTTP/1.1 500 Internal Server Error\r\nConnection: close\r\n\r\nunable to create save file - %v", err)))
+			return
+		}
+
+		out := wireResponse(req, res, 1, 1)
+		_, err = client.Write(out)
+
+		conn.Record(Inbound, session.RawRequest())
+		conn.Record(Outbound, out)
+		deactivateSession(session)
+		Broadcast(SessionUpdated, conn.ToApiSession())
 
+		if err != nil || req.Close {
+			return
+		}
 	}
+}
 
-	deactivateSession(session)
-	_ = client.Close()
+// serveHTTP2Conn serves the http/2 prior knowledge connection, each stream is captured in its own http session linked to
+// the connection session
+func serveHTTP2Conn(conn *Session, client net.Conn) {
+	server := &http2.Server{IdleTimeout: httpKeepAliveTimeout}
+	server.ServeConn(client, &http2.ServeConnOpts{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		session, res, err := captureHTTPRequest(conn, req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to create save file - %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		for name, values := range res.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(res.StatusCode)
+		_, _ = w.Write(res.Body)
+
+		conn.Record(Inbound, session.RawRequest())
+		conn.Record(Outbound, wireResponse(req, res, 2, 0))
+		deactivateSession(session)
+		Broadcast(SessionUpdated, conn.ToApiSession())
+	})})
+}
+
+// captureHTTPRequest creates the http session of a request received on the connection session conn and builds its
+// response, the session has the addresses of the connection
+func captureHTTPRequest(conn *Session, req *http.Request) (*Session, *HTTPResponseJSON, error) {
+	conn.mu.RLock()
+	ip, hop, tlsInfo := conn.IP, conn.HopIP, conn.TLS
+	conn.mu.RUnlock()
+
+	session, err := createSession(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.mu.Lock()
+	session.HopIP = hop
+	session.TLS = tlsInfo
+	session.mu.Unlock()
+	conn.AddChild(session)
+	session.InitializeHTTP(req)
+
+	res, autoResponse := NewSessionResponse(session, req)
+	res.Header["X-Session-URL"] = []string{fmt.Sprintf("%s/v/%s", *publicUrl, session.Key)}
+	res.Header["Date"] = []string{time.Now().UTC().Format(http.TimeFormat)}
+	session.SetHTTPResponse(res, autoResponse)
+	return session, res, nil
+}
+
+// wireResponse returns the response in http/1.x wire format, the status line has the version of the connection
+func wireResponse(req *http.Request, res *HTTPResponseJSON, protoMajor, protoMinor int) []byte {
+	response := &http.Response{}
+	response.StatusCode = res.StatusCode
+	response.Proto = fmt.Sprintf("HTTP/%d.%d", protoMajor, protoMinor)
+	response.ProtoMajor = protoMajor
+	response.ProtoMinor = protoMinor
+	response.Request = req
+	response.Header = res.Header
+	response.Body = io.NopCloser(bytes.NewReader(res.Body))
+	response.ContentLength = int64(len(res.Body))
+	response.Close = req.Close
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	_ = response.Write(w)
+	_ = w.Flush()
+	return out.Bytes()
 }
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/dustin/go-humanize"
@@ -15,8 +16,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,18 +32,65 @@ const (
 
 	// HTTP enum to define http protocol
 	HTTP = 1
+
+	// HTTP1 enum to define a connection of http/1.x requests, each request is captured in its own HTTP session
+	HTTP1 Protocol = 2
+
+	// HTTP2 enum to define a connection of http/2 prior knowledge requests, each request is captured in its own HTTP
+	// session
+	HTTP2 Protocol = 3
+
+	// TLS enum to define a tls connection whose decrypted stream is not a protocol dumpr decodes
+	TLS Protocol = 4
+
+	// SMTP enum to define a smtp connection
+	SMTP Protocol = 5
+
+	// Redis enum to define a connection of redis RESP commands
+	Redis Protocol = 6
+
+	// Mail enum to define a mail message received on a SMTP connection
+	Mail Protocol = 7
+
+	// UDP enum to define the datagrams received from a source address until it is idle
+	UDP Protocol = 8
+)
+
+// Protocols the protocols a session can have, in enum order
+var Protocols = []Protocol{TCP, HTTP, HTTP1, HTTP2, TLS, SMTP, Redis, Mail, UDP}
+
+// Direction enum to define the direction of recorded traffic
+type Direction int
+
+const (
+	// Inbound traffic sent by the client
+	Inbound Direction = 0
+
+	// Outbound traffic sent to the client, by dumpr or the upstream of a forwarded session
+	Outbound Direction = 1
 )
 
+// String return the human-readable form of Direction enum
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return "unknown"
+}
+
 var (
-	// Sessions map of all sessions
-	Sessions = make(map[string]*Session)
+	// Sessions registry of all sessions
+	Sessions = NewSessionStore()
 )
 
 // GetInActiveSessions returns a sorted list of inactive sessions, sorted by age
 func GetInActiveSessions() []*ApiSession {
 	list := make([]*ApiSession, 0)
-	for _, v := range Sessions {
-		if !v.Active {
+	for _, v := range Sessions.List() {
+		if !v.IsActive() {
 			list = append(list, v.ToApiSession())
 		}
 	}
@@ -53,8 +103,8 @@ func GetInActiveSessions() []*ApiSession {
 // GetActiveSessions returns a sorted list of active sessions, sorted by age
 func GetActiveSessions() []*ApiSession {
 	list := make([]*ApiSession, 0)
-	for _, v := range Sessions {
-		if v.Active {
+	for _, v := range Sessions.List() {
+		if v.IsActive() {
 			list = append(list, v.ToApiSession())
 		}
 	}
@@ -68,7 +118,7 @@ func GetActiveSessions() []*ApiSession {
 // GetAllSessions returns a sorted list of all sessions, sorted by age
 func GetAllSessions() []*ApiSession {
 	list := make([]*ApiSession, 0)
-	for _, v := range Sessions {
+	for _, v := range Sessions.List() {
 		list = append(list, v.ToApiSession())
 	}
 	sort.SliceStable(list, func(i, j int) bool {
@@ -77,6 +127,22 @@ func GetAllSessions() []*ApiSession {
 	return list
 }
 
+func hasLabels(labels, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, l := range labels {
+			if strings.EqualFold(l, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // String return the human-readable form of Protocol enum
 func (s Protocol) String() string {
 	switch s {
@@ -84,10 +150,40 @@ func (s Protocol) String() string {
 		return "http"
 	case TCP:
 		return "tcp"
+	case HTTP1:
+		return "http1"
+	case HTTP2:
+		return "http2"
+	case TLS:
+		return "tls"
+	case SMTP:
+		return "smtp"
+	case Redis:
+		return "redis"
+	case Mail:
+		return "mail"
+	case UDP:
+		return "udp"
 	}
 	return "unknown"
 }
 
+// ParseProtocol returns the Protocol of a name returned by Protocol.String
+func ParseProtocol(name string) (Protocol, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, p := range Protocols {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	names := make([]string, 0, len(Protocols))
+	for _, p := range Protocols {
+		names = append(names, p.String())
+	}
+	return TCP, fmt.Errorf("unknown protocol %q, expected %s", name, strings.Join(names, ", "))
+}
+
 // MultiPartFile struct to store details of a multipart form upload
 type MultiPartFile struct {
 	File      string `json:"file"`
@@ -95,9 +191,11 @@ type MultiPartFile struct {
 	HumanSize string `json:"humanSize"`
 }
 
-// Session struct to store details of a session
+// Session struct to store details of a session. mu guards the fields that change while the session is active.
 type Session struct {
+	mu             sync.RWMutex
 	IP             string                    `json:"ip"`
+	HopIP          string                    `json:"hopIp,omitempty"`
 	SaveFile       string                    `json:"file"`
 	Key            string                    `json:"key"`
 	StartTime      time.Time                 `json:"startTime"`
@@ -105,21 +203,50 @@ type Session struct {
 	Viewers        []*melody.Session         `json:"-"`
 	Protocol       Protocol                  `json:"protocol"`
 	MultiPartFiles map[string]*MultiPartFile `json:"multipartFiles"`
-	outputFile     *os.File
-	Active         bool             `json:"active"`
-	HTTPMethod     string           `json:"httpMethod"`
-	HTTPPath       string           `json:"httpPath"`
-	HandledByRule  string           `json:"handled_by_rule"`
-	HTTPSession    *HTTPRequestJSON `json:"-"`
+	outputFile     io.WriteCloser
+	Active         bool              `json:"active"`
+	HTTPMethod     string            `json:"httpMethod"`
+	HTTPPath       string            `json:"httpPath"`
+	HandledByRule  string            `json:"handled_by_rule"`
+	RuleVersion    int               `json:"handled_by_rule_version,omitempty"`
+	HTTPResponse   *HTTPResponseJSON `json:"httpResponse,omitempty"`
+	HTTPSession    *HTTPRequestJSON  `json:"-"`
+	MailSession    *MailMessage      `json:"-"`
+	TLS            *TLSInfo          `json:"tls,omitempty"`
+	Upstream       string            `json:"upstream,omitempty"`
+	BytesIn        int64             `json:"bytesIn"`
+	BytesOut       int64             `json:"bytesOut"`
+	Datagrams      int64             `json:"datagrams,omitempty"`
+	FramesFile     string            `json:"framesFile,omitempty"`
+	ReplayOf       string            `json:"replayOf,omitempty"`
+	Replays        []string          `json:"replays,omitempty"`
+	Resends        []*ResendResult   `json:"resends,omitempty"`
+	Parent         string            `json:"parent,omitempty"`
+	Children       []string          `json:"children,omitempty"`
+	Bin            string            `json:"bin,omitempty"`
+	Redacted       []string          `json:"redacted,omitempty"`
+	Pinned         bool              `json:"pinned,omitempty"`
+	Labels         []string          `json:"labels,omitempty"`
+	Notes          string            `json:"notes,omitempty"`
+	framesOutput   *FrameWriter
+	lastDirection  Direction
+	redactHeld     [2][]byte
+	sizeMu         sync.Mutex
+	sizeCache      *SizeResult
+	viewerFormats  map[*melody.Session]string
+	outputOffset   int64
+	purged         bool
 }
 
 // ApiSession struct to store details of a session to be returned via web service in json form
 type ApiSession struct {
 	IP                string                    `json:"ip"`
+	HopIP             string                    `json:"hopIp,omitempty"`
 	Key               string                    `json:"key"`
 	StartTime         string                    `json:"startTime"`
 	EndTime           string                    `json:"endTime"`
 	Protocol          Protocol                  `json:"protocol"`
+	ProtocolName      string                    `json:"protocolName"`
 	MultiPartFiles    map[string]*MultiPartFile `json:"multipartFiles"`
 	Active            bool                      `json:"active"`
 	HTTPMethod        string                    `json:"httpMethod"`
@@ -131,31 +258,438 @@ type ApiSession struct {
 	Description       string                    `json:"description"`
 	HandledByRule     string                    `json:"handled_by_rule"`
 	Size              *SizeResult               `json:"size"`
+	TLS               *TLSInfo                  `json:"tls,omitempty"`
+	Upstream          string                    `json:"upstream,omitempty"`
+	BytesIn           int64                     `json:"bytesIn"`
+	BytesOut          int64                     `json:"bytesOut"`
+	Datagrams         int64                     `json:"datagrams,omitempty"`
+	ReplayOf          string                    `json:"replayOf,omitempty"`
+	Replays           []string                  `json:"replays,omitempty"`
+	Parent            string                    `json:"parent,omitempty"`
+	Children          []string                  `json:"children,omitempty"`
+	Bin               string                    `json:"bin,omitempty"`
+	Redacted          []string                  `json:"redacted,omitempty"`
+	Pinned            bool                      `json:"pinned"`
+	Labels            []string                  `json:"labels,omitempty"`
+	Notes             string                    `json:"notes,omitempty"`
 }
 
 // ToApiSession returns the struct for web consumption of the Session
 func (s *Session) ToApiSession() *ApiSession {
+	return s.toApiSession(true)
+}
+
+// toApiSession returns the ApiSession, the size is left nil unless withSize is set, it needs the size of the raw file
+func (s *Session) toApiSession(withSize bool) *ApiSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	multiPartFiles := make(map[string]*MultiPartFile, len(s.MultiPartFiles))
+	for k, v := range s.MultiPartFiles {
+		multiPartFiles[k] = v
+	}
+
 	apiSession := &ApiSession{
 		IP:                s.IP,
+		HopIP:             s.HopIP,
 		Key:               s.Key,
 		StartTime:         s.FormattedStartTime(),
-		EndTime:           s.FormattedEndTime(),
+		EndTime:           s.EndTime.Format(time.ANSIC),
 		Protocol:          s.Protocol,
-		MultiPartFiles:    s.MultiPartFiles,
+		ProtocolName:      s.Protocol.String(),
+		MultiPartFiles:    multiPartFiles,
 		Active:            s.Active,
 		HTTPMethod:        s.HTTPMethod,
 		HTTPPath:          s.HTTPPath,
 		AgeMs:             s.AgeMs(),
 		Age:               s.Age(),
 		StartTimeMs:       s.StartTime.Unix(),
-		SessionActiveTime: s.SessionActiveTime(),
-		Description:       s.Description(),
+		SessionActiveTime: s.sessionActiveTime(),
+		Description:       s.description(),
 		HandledByRule:     s.HandledByRule,
-		Size:              s.Size(),
+		TLS:               s.TLS,
+		Upstream:          s.Upstream,
+		BytesIn:           s.BytesIn,
+		BytesOut:          s.BytesOut,
+		Datagrams:         s.Datagrams,
+		ReplayOf:          s.ReplayOf,
+		Replays:           append([]string(nil), s.Replays...),
+		Parent:            s.Parent,
+		Children:          append([]string(nil), s.Children...),
+		Bin:               s.Bin,
+		Redacted:          append([]string(nil), s.Redacted...),
+		Pinned:            s.Pinned,
+		Labels:            append([]string(nil), s.Labels...),
+		Notes:             s.Notes,
+	}
+	if withSize {
+		apiSession.Size = s.size()
 	}
 	return apiSession
 }
 
+// SessionAnnotations the user editable fields of a session sent to PATCH /api/info/:name, nil fields are left
+// unchanged and an empty labels list removes the labels.
+type SessionAnnotations struct {
+	Pinned *bool    `json:"pinned"`
+	Labels []string `json:"labels"`
+	Notes  *string  `json:"notes"`
+}
+
+// maxNotesLength upper bound of the notes of a session
+const maxNotesLength = 10000
+
+// labelRegex valid session labels, commas separate the labels of the list filters
+var labelRegex = regexp.MustCompile(`^[^,\s][^,]{0,63}$`)
+
+// Annotate updates the pinned flag, labels and notes of the session and stores the session
+func (s *Session) Annotate(a *SessionAnnotations) error {
+	var labels []string
+	if a.Labels != nil {
+		labels = make([]string, 0, len(a.Labels))
+		for _, l := range a.Labels {
+			l = strings.TrimSpace(l)
+			if !labelRegex.MatchString(l) {
+				return fmt.Errorf("invalid label %q, labels are 1 to 64 characters without commas", l)
+			}
+			if !hasLabels(labels, []string{l}) {
+				labels = append(labels, l)
+			}
+		}
+	}
+
+	if a.Notes != nil && len(*a.Notes) > maxNotesLength {
+		return fmt.Errorf("notes are limited to %d characters", maxNotesLength)
+	}
+
+	s.mu.Lock()
+	if a.Pinned != nil {
+		s.Pinned = *a.Pinned
+	}
+	if labels != nil {
+		s.Labels = labels
+	}
+	if a.Notes != nil {
+		s.Notes = *a.Notes
+	}
+	s.mu.Unlock()
+	Sessions.Reindex(s)
+
+	err := StoreSession(s)
+	if err != nil {
+		return err
+	}
+	Broadcast(SessionUpdated, s.ToApiSession())
+	return nil
+}
+
+// LabelList returns a copy of the labels of the session
+func (s *Session) LabelList() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.Labels...)
+}
+
+// IsPinned returns true if the session is exempt from the retention policy
+func (s *Session) IsPinned() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Pinned
+}
+
+// blobNames returns the names of the raw capture, frames, uploaded files and resend results of the session, names of
+// blobs the session does not have are empty
+func (s *Session) blobNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := []string{s.SaveFile, s.FramesFile}
+	for _, f := range s.MultiPartFiles {
+		names = append(names, f.File)
+	}
+	for _, r := range s.Resends {
+		names = append(names, r.File)
+	}
+	return names
+}
+
+// DiskUsage returns the bytes used by the raw capture, frames, uploaded files and resend results of the session
+func (s *Session) DiskUsage() int64 {
+	var total int64
+	for _, name := range s.blobNames() {
+		if name == "" {
+			continue
+		}
+		size, err := store.Blobs().Size(name)
+		if err == nil {
+			total += size
+		}
+	}
+	return total
+}
+
+// IsActive returns true while the session is still capturing
+func (s *Session) IsActive() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Active
+}
+
+// SetHTTPResponse records the response sent back for a http session and the AutoResponse rule that produced it
+func (s *Session) SetHTTPResponse(response *HTTPResponseJSON, rule *AutoResponse) {
+	s.mu.Lock()
+	s.HTTPResponse = response
+	if rule != nil {
+		s.HandledByRule = rule.Name
+		s.RuleVersion = rule.Version
+	}
+	s.mu.Unlock()
+	Sessions.Reindex(s)
+}
+
+// ProtocolType returns the protocol of the session, it changes while a tcp connection is being classified
+func (s *Session) ProtocolType() Protocol {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Protocol
+}
+
+// UploadedFile returns the uploaded file or mail attachment of the session saved under name
+func (s *Session) UploadedFile(name string) (*MultiPartFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.MultiPartFiles[name]
+	return f, ok
+}
+
+// SetProtocol records the protocol detected on the connection of the session
+func (s *Session) SetProtocol(protocol Protocol) {
+	s.mu.Lock()
+	s.Protocol = protocol
+	s.mu.Unlock()
+	Sessions.Reindex(s)
+}
+
+// SetClientIP records the address of the client given by a trusted proxy, the address the connection came from is kept
+// as the hop
+func (s *Session) SetClientIP(ip string) {
+	s.mu.Lock()
+	if s.IP != ip {
+		s.HopIP = s.IP
+		s.IP = ip
+	}
+	s.mu.Unlock()
+	Sessions.Reindex(s)
+}
+
+// BinName returns the name of the bin the session was captured in
+func (s *Session) BinName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Bin
+}
+
+// AddChild links a http request session to the connection session it was received on
+func (s *Session) AddChild(child *Session) {
+	child.mu.Lock()
+	child.Parent = s.Key
+	child.mu.Unlock()
+
+	s.mu.Lock()
+	s.Children = append(s.Children, child.Key)
+	s.mu.Unlock()
+	Sessions.Touch()
+}
+
+// Watch sends the recorded traffic of the session to the websocket viewer with send as one history frame, then
+// registers the viewer for the live traffic rendered in format. The session lock is held across both steps so no
+// traffic recorded in between is lost. A registered viewer switches format by calling Watch again.
+func (s *Session) Watch(viewer *melody.Session, format string, send func(frame *ViewFrame) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := &ViewFrame{Type: FrameHistory, Format: format, Frames: make([]*ViewFrame, 0)}
+	err := s.writeHistoryFramesLocked(format, func(frame *ViewFrame) error {
+		history.Frames = append(history.Frames, frame)
+		return nil
+	})
+	if err == nil {
+		err = send(history)
+	}
+	if err != nil {
+		s.removeViewerLocked(viewer)
+		return err
+	}
+	s.addViewerLocked(viewer, format)
+	return nil
+}
+
+// addViewerLocked registers a websocket viewer of the session, the traffic is sent to the viewer rendered in format,
+// s.mu must be held
+func (s *Session) addViewerLocked(viewer *melody.Session, format string) {
+	if s.viewerFormats == nil {
+		s.viewerFormats = make(map[*melody.Session]string)
+	}
+	if _, ok := s.viewerFormats[viewer]; !ok {
+		s.Viewers = append(s.Viewers, viewer)
+	}
+	s.viewerFormats[viewer] = format
+}
+
+// RemoveViewer removes a websocket viewer of the session
+func (s *Session) RemoveViewer(viewer *melody.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeViewerLocked(viewer)
+}
+
+func (s *Session) removeViewerLocked(viewer *melody.Session) {
+	s.Viewers = removeElement(s.Viewers, viewer)
+	delete(s.viewerFormats, viewer)
+}
+
+// viewerGroups returns the viewers grouped by render format, s.mu must be held
+func (s *Session) viewerGroups() map[string][]*melody.Session {
+	groups := make(map[string][]*melody.Session)
+	for _, v := range s.Viewers {
+		format, ok := s.viewerFormats[v]
+		if !ok {
+			format = RenderText
+		}
+		groups[format] = append(groups[format], v)
+	}
+	return groups
+}
+
+// ViewerList returns a copy of the websocket viewers of the session
+func (s *Session) ViewerList() []*melody.Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	viewers := make([]*melody.Session, len(s.Viewers))
+	copy(viewers, s.Viewers)
+	return viewers
+}
+
+// SetUpstream records the upstream host:port of a forwarded session
+func (s *Session) SetUpstream(upstream string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Upstream = upstream
+}
+
+// addRedacted notes that v was masked in the recorded data, the caller must hold s.mu
+func (s *Session) addRedacted(v string) {
+	for _, r := range s.Redacted {
+		if r == v {
+			return
+		}
+	}
+	s.Redacted = append(s.Redacted, v)
+}
+
+// Record appends the traffic to the session save file with the direction and time it was seen, and sends it to the
+// viewers of the session. The redaction regexes are applied to what is saved and sent to viewers, pay is not modified.
+// The end of the traffic may be held back until the next chunk so a pattern split across chunks is masked, see
+// Redactor.RedactStream. Returns the total number of bytes recorded.
+func (s *Session) Record(dir Direction, pay []byte) int64 {
+	size := int64(len(pay))
+
+	s.mu.Lock()
+	if s.outputFile == nil {
+		total := s.BytesIn + s.BytesOut
+		s.mu.Unlock()
+		return total
+	}
+
+	now := time.Now()
+	var chunks []*recordedChunk
+	if other := 1 - dir; len(s.redactHeld[other]) > 0 {
+		// the direction changed, what is held back of the other direction is written first to keep the order
+		chunks = append(chunks, s.writeRedactedLocked(now, other, nil, true))
+	}
+	chunks = append(chunks, s.writeRedactedLocked(now, dir, pay, s.Protocol == UDP))
+
+	if dir == Inbound {
+		s.BytesIn += size
+	} else {
+		s.BytesOut += size
+	}
+	total := s.BytesIn + s.BytesOut
+	viewers := s.viewerGroups()
+	s.mu.Unlock()
+
+	for _, c := range chunks {
+		if c != nil {
+			broadcastView(viewers, now, c.dir, c.pay, c.offset, c.marker)
+		}
+	}
+	return total
+}
+
+// recordedChunk traffic written to the session save file, to be sent to the viewers
+type recordedChunk struct {
+	dir    Direction
+	pay    []byte
+	offset int64
+	marker []byte
+}
+
+// writeRedactedLocked masks pay following the traffic held back for dir and writes what is not held back to the save
+// and frames files, final writes everything. Returns nil if nothing was written, s.mu must be held.
+func (s *Session) writeRedactedLocked(now time.Time, dir Direction, pay []byte, final bool) *recordedChunk {
+	pay, held, masked := redactor.RedactStream(s.redactHeld[dir], pay, final)
+	s.redactHeld[dir] = held
+	for _, v := range masked {
+		s.addRedacted(v)
+	}
+	if len(pay) == 0 {
+		return nil
+	}
+
+	if s.framesOutput == nil {
+		framesOutput, err := NewFrameWriter(s.FramesFile, s.StartTime)
+		if err != nil {
+			fmt.Printf("Session %s unable to create frames file: %v\n", s.Key, err)
+		}
+		s.framesOutput = framesOutput
+	}
+	if s.framesOutput != nil {
+		_ = s.framesOutput.Write(now, dir, pay)
+	}
+
+	var marker []byte
+	switch {
+	case s.Protocol == UDP:
+		marker = datagramMarker(now, len(pay))
+	case s.Upstream != "" && (s.outputOffset == 0 || s.lastDirection != dir):
+		marker = directionMarker(now, dir)
+	}
+	s.lastDirection = dir
+	_, _ = s.outputFile.Write(pay)
+	offset := s.outputOffset
+	s.outputOffset += int64(len(pay))
+	return &recordedChunk{dir: dir, pay: pay, offset: offset, marker: marker}
+}
+
+// Frames returns the timeline of the recorded traffic, the payloads are only included if withData is set
+func (s *Session) Frames(withData bool) ([]*Frame, error) {
+	if !BlobExists(s.FramesFile) {
+		return make([]*Frame, 0), nil
+	}
+	return ReadFrames(s.FramesFile, withData)
+}
+
+func directionMarker(t time.Time, dir Direction) []byte {
+	label := "client -> upstream"
+	if dir == Outbound {
+		label = "upstream -> client"
+	}
+	return []byte(fmt.Sprintf("\r\n\x1b[36m--- %s %s ---\x1b[0m\r\n", t.Format("15:04:05.000"), label))
+}
+
+func datagramMarker(t time.Time, size int) []byte {
+	return []byte(fmt.Sprintf("\r\n\x1b[36m--- %s datagram %d bytes ---\x1b[0m\r\n", t.Format("15:04:05.000"), size))
+}
+
 // AgeMs returns the age in ms of age of the session
 func (s *Session) AgeMs() int64 {
 	age := time.Now().Sub(s.StartTime)
@@ -171,6 +705,12 @@ func (s *Session) Age() string {
 
 // SessionActiveTime returns the duration of session in human-readable format
 func (s *Session) SessionActiveTime() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessionActiveTime()
+}
+
+func (s *Session) sessionActiveTime() string {
 	d := s.EndTime.Sub(s.StartTime)
 	duration := durafmt.Parse(d)
 	return duration.Format(duraFormatOverride)
@@ -183,11 +723,19 @@ func (s *Session) FormattedStartTime() string {
 
 // FormattedEndTime returns formatted end time
 func (s *Session) FormattedEndTime() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.EndTime.Format(time.ANSIC)
 }
 
 // Description returns the description of a session for web
 func (s *Session) Description() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.description()
+}
+
+func (s *Session) description() string {
 	var sb strings.Builder
 
 	if s.Protocol == HTTP {
@@ -195,7 +743,34 @@ func (s *Session) Description() string {
 		return sb.String()
 	}
 
-	if s.Protocol == TCP {
+	if s.Protocol == Mail && s.MailSession != nil {
+		from := s.MailSession.From
+		if from == "" {
+			from = "<>"
+		}
+		sb.WriteString(fmt.Sprintf("%s to %s: %s", from, strings.Join(s.MailSession.To, ", "), s.MailSession.Subject))
+		return sb.String()
+	}
+
+	if s.Protocol != HTTP {
+		switch {
+		case len(s.Children) > 0 && s.Protocol == TCP:
+			sb.WriteString(fmt.Sprintf("HTTP connection requests: %d", len(s.Children)))
+		case len(s.Children) > 0 && s.Protocol == SMTP:
+			sb.WriteString(fmt.Sprintf("SMTP connection messages: %d", len(s.Children)))
+		case s.Protocol == UDP:
+			sb.WriteString(fmt.Sprintf("UDP datagrams: %d in: %s", s.Datagrams, humanize.Bytes(uint64(s.BytesIn))))
+		case len(s.Children) > 0:
+			sb.WriteString(fmt.Sprintf("%s connection requests: %d", strings.ToUpper(s.Protocol.String()), len(s.Children)))
+		case s.Protocol != TCP:
+			sb.WriteString(strings.ToUpper(s.Protocol.String()))
+		}
+		if s.ReplayOf != "" {
+			sb.WriteString(fmt.Sprintf("Replay of %s ", s.ReplayOf))
+		}
+		if s.Upstream != "" {
+			sb.WriteString(fmt.Sprintf("Forwarded to %s in: %s out: %s", s.Upstream, humanize.Bytes(uint64(s.BytesIn)), humanize.Bytes(uint64(s.BytesOut))))
+		}
 		if s.Active {
 			sb.WriteString(fmt.Sprintf(" Session Active"))
 		} else {
@@ -220,46 +795,71 @@ type SizeResult struct {
 
 // Size returns the SizeResult struct to return the raw size and formatted size to the template engine
 func (s *Session) Size() *SizeResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size()
+}
+
+func (s *Session) size() *SizeResult {
 	result := &SizeResult{}
-	if s.Protocol == HTTP {
+	if s.Protocol == HTTP && s.HTTPSession != nil {
 		result.Val = s.HTTPSession.ContentLength
 		result.FormattedVal = humanize.Bytes(uint64(s.HTTPSession.ContentLength))
 		return result
 	}
 
-	fi, err := os.Stat(s.SaveFile)
+	// the raw file of a finished session does not change, its size is looked up once
+	if !s.Active {
+		s.sizeMu.Lock()
+		cached := s.sizeCache
+		s.sizeMu.Unlock()
+		if cached != nil {
+			return cached
+		}
+	}
+
+	size, err := store.Blobs().Size(s.SaveFile)
 	if err != nil {
 		result.Val = 0
 		result.FormattedVal = fmt.Sprintf(" Unable to get file size: %v", err)
 		return result
 	}
 
-	result.Val = fi.Size()
-	result.FormattedVal = humanize.Bytes(uint64(fi.Size()))
+	result.Val = size
+	result.FormattedVal = humanize.Bytes(uint64(size))
+	if !s.Active {
+		s.sizeMu.Lock()
+		s.sizeCache = result
+		s.sizeMu.Unlock()
+	}
 	return result
 }
 
 // Bytes returns the bytes of the json formatted of the Session
 func (s *Session) Bytes() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	dump, _ := json.MarshalIndent(s, "", "    ")
 	return dump
 }
 
 // String returns the string of the json formatted of the Session
 func (s *Session) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	dump, _ := json.MarshalIndent(s, "", "    ")
 	return string(dump)
 }
 
 // IsValid returns state of the session, if the assets of the Session do not exist, will return false
 func (s *Session) IsValid() (bool, error) {
-	valid := FileExists(s.SaveFile)
+	valid := BlobExists(s.SaveFile)
 	if !valid {
 		return false, fmt.Errorf("%s does not exist", s.SaveFile)
 	}
 
 	for _, f := range s.MultiPartFiles {
-		valid = FileExists(f.File)
+		valid = BlobExists(f.File)
 		if !valid {
 			return false, fmt.Errorf("%s does not exist", f.File)
 		}
@@ -269,7 +869,13 @@ func (s *Session) IsValid() (bool, error) {
 
 // InitializeHTTP update the Session with Http Request details
 func (s *Session) InitializeHTTP(req *http.Request) {
-	s.Protocol = HTTP
+	// keep the body as sent, parsing the form consumes it
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		body = []byte(fmt.Sprintf("Error reading body: %v", err))
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
 	_ = req.ParseForm()
 	_ = req.ParseMultipartForm(MaxMultipartMemory)
 
@@ -292,16 +898,24 @@ func (s *Session) InitializeHTTP(req *http.Request) {
 		}
 	}
 
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	request := NewHTTPRequestJSON(req)
+
+	s.mu.Lock()
+	s.Protocol = HTTP
 	s.HTTPMethod = req.Method
 	s.HTTPPath = req.RequestURI
 	s.Active = true
-
-	request := NewHTTPRequestJSON(req)
 	if request != nil {
 		s.HTTPSession = request
+		for _, v := range request.Redacted {
+			s.addRedacted(v)
+		}
 		dump, _ := json.MarshalIndent(request, "", "    ")
 		_, _ = s.outputFile.Write(dump)
 	}
+	s.mu.Unlock()
+	Sessions.Reindex(s)
 
 	Broadcast(SessionUpdated, s.ToApiSession())
 }
@@ -312,7 +926,7 @@ func (s *Session) LoadHTTPRequestJSON() error {
 		return fmt.Errorf("not a http protocol based session")
 	}
 
-	httpSessionBytes, err := os.ReadFile(s.SaveFile)
+	httpSessionBytes, err := ReadBlob(s.SaveFile)
 	if err != nil {
 		return err
 	}
@@ -341,14 +955,20 @@ func FileExists(name string) bool {
 }
 
 func copyMultiPartFile(session *Session, fileInfo *multipart.FileHeader, f multipart.File) error {
+	return saveSessionFile(session, fileInfo.Filename, f)
+}
+
+// saveSessionFile saves a file of the session, e.g. an uploaded file or a mail attachment, it is listed in
+// MultiPartFiles under name. The redaction regexes are applied to the content, the form field and json path rules do
+// not apply to files.
+func saveSessionFile(session *Session, name string, r io.Reader) error {
 
 	sessionSaveDir := fmt.Sprintf("%s/%s", *saveDir, session.StartTime.Format("20060102"))
 	sessionFileDir := fmt.Sprintf("%s/%s.files", sessionSaveDir, session.Key)
-	_ = os.MkdirAll(sessionFileDir, 0777)
 
-	file := fmt.Sprintf("%s/%s", sessionFileDir, fileInfo.Filename)
+	file := fmt.Sprintf("%s/%s", sessionFileDir, name)
 
-	destination, err := os.Create(file)
+	destination, err := store.Blobs().Create(file)
 	if err != nil {
 		fmt.Printf("Error Saving File: %s  - error: %v\n", file, err)
 		return err
@@ -357,42 +977,71 @@ func copyMultiPartFile(session *Session, fileInfo *multipart.FileHeader, f multi
 		_ = destination.Close()
 	}()
 
-	var nBytes int64
-	nBytes, err = io.Copy(destination, f)
+	nBytes, masked, err := redactor.RedactCopy(destination, r)
 	if err != nil {
 		return err
 	}
 
 	mpFile := &MultiPartFile{File: file, Size: nBytes, HumanSize: ByteCountDecimal(nBytes)}
-	session.MultiPartFiles[fileInfo.Filename] = mpFile
+	session.mu.Lock()
+	session.MultiPartFiles[name] = mpFile
+	for _, v := range masked {
+		session.addRedacted(v)
+	}
+	session.mu.Unlock()
 	fmt.Printf("Saved File: %s  - bytes: %d\n", file, nBytes)
 	return nil
 }
 
 func deactivateSession(session *Session) {
+	session.mu.Lock()
 	if !session.Active {
+		session.mu.Unlock()
 		fmt.Printf("Skipping session %s - already saved\n", session.Key)
 		return
 	}
 	fmt.Printf("Closing down session %s - %s\n", session.Key, session.SaveFile)
 
+	now := time.Now()
+	var chunks []*recordedChunk
+	for _, dir := range []Direction{session.lastDirection, 1 - session.lastDirection} {
+		if len(session.redactHeld[dir]) > 0 {
+			chunks = append(chunks, session.writeRedactedLocked(now, dir, nil, true))
+		}
+	}
+	groups := session.viewerGroups()
+
 	_ = session.outputFile.Close()
+	session.outputFile = nil
+	if session.framesOutput != nil {
+		_ = session.framesOutput.Close()
+		session.framesOutput = nil
+	}
+	session.Active = false
+	session.EndTime = time.Now()
+	viewers := session.Viewers
+	session.Viewers = make([]*melody.Session, 0)
+	session.viewerFormats = nil
+	session.mu.Unlock()
 
-	_ = m.BroadcastMultiple([]byte("session shut down"), session.Viewers)
+	for _, c := range chunks {
+		if c != nil {
+			broadcastView(groups, now, c.dir, c.pay, c.offset, c.marker)
+		}
+	}
+	sendFrame(viewers, &ViewFrame{Type: FrameStatus, Content: "session shut down"})
 
-	for _, v := range session.Viewers {
+	for _, v := range viewers {
 		_ = v.Close()
 	}
-	session.Active = false
-	session.EndTime = time.Now()
 	Broadcast(SessionUpdated, session.ToApiSession())
 	_ = StoreSession(session)
 }
 
 // SaveAllSessions saves all open sessions to db. Called before shutdown
 func SaveAllSessions() {
-	for _, sess := range Sessions {
-		if sess.Active {
+	for _, sess := range Sessions.List() {
+		if sess.IsActive() {
 			fmt.Printf("Saving session session %s\n", sess.Key)
 			deactivateSession(sess)
 		}
@@ -400,10 +1049,16 @@ func SaveAllSessions() {
 }
 
 func createSession(ip string) (*Session, error) {
+	return createBinSession(ip, "")
+}
+
+// createBinSession creates a session captured in the named bin, an empty bin creates an anonymous session
+func createBinSession(ip, bin string) (*Session, error) {
 
-	hashKey := make([]int64, 1)
-	hashKey[0] = time.Now().Unix()
-	key, _ := hasher.EncodeInt64(hashKey)
+	key, err := NewSessionKey()
+	if err != nil {
+		return nil, err
+	}
 
 	session := &Session{}
 	session.Key = key
@@ -411,19 +1066,23 @@ func createSession(ip string) (*Session, error) {
 	session.StartTime = time.Now()
 	session.IP = ip
 	session.Protocol = TCP
+	session.Bin = bin
 	session.MultiPartFiles = make(map[string]*MultiPartFile)
 	sessionSaveDir := fmt.Sprintf("%s/%s", *saveDir, session.StartTime.Format("20060102"))
 	sessionSaveFile := fmt.Sprintf("%s/%s.raw", sessionSaveDir, key)
 	session.Active = true
-	_ = os.MkdirAll(sessionSaveDir, 0777)
-	outputFile, err := os.Create(sessionSaveFile)
+	outputFile, err := store.Blobs().Create(sessionSaveFile)
 	if err != nil {
 		return nil, err
 	}
 
 	session.SaveFile = sessionSaveFile
-	Sessions[key] = session
+	session.FramesFile = fmt.Sprintf("%s/%s.frames", sessionSaveDir, key)
 	session.outputFile = outputFile
+	if !Sessions.PutIfAbsent(session) {
+		_ = outputFile.Close()
+		return nil, fmt.Errorf("session key %s already in use", key)
+	}
 	err = StoreSession(session)
 
 	Broadcast(SessionCreated, session.ToApiSession())
@@ -461,16 +1120,23 @@ func PurgeSession(s *Session) {
 
 	fmt.Printf("Purging Session: %v\n", s.Key)
 
-	_ = os.Remove(s.SaveFile)
-	for _, f := range s.MultiPartFiles {
-		_ = os.Remove(f.File)
+	blobs := store.Blobs()
+	for _, name := range s.blobNames() {
+		if name != "" {
+			_ = blobs.Remove(name)
+		}
 	}
 
+	// a StoreSession still running for the session finishes before purged is set, a later one is skipped
+	s.mu.Lock()
+	s.purged = true
+	s.mu.Unlock()
+
 	err := DeleteSession(s.Key)
 	if err != nil {
 		fmt.Printf("Error deleting session: %s error: %v\n", s.Key, err)
 	}
 
-	delete(Sessions, s.Key)
-	Broadcast(SessionDeleted, s.Key)
+	Sessions.Delete(s.Key)
+	BroadcastBin(SessionDeleted, s.Key, s.BinName())
 }
@@ -0,0 +1,248 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultListLimit sessions returned by a list request without a limit
+	defaultListLimit = 100
+
+	// maxListLimit upper bound of the limit of a list request
+	maxListLimit = 1000
+)
+
+// apiSessionFields json names of the ApiSession fields, the values accepted by ?fields=
+var apiSessionFields = jsonFieldNames(reflect.TypeOf(ApiSession{}))
+
+// ListQuery paging and field selection of the session list endpoints. The sessions are listed newest first, a page
+// at a time.
+type ListQuery struct {
+	Limit  int
+	Cursor *ListCursor
+	Fields []string
+	Labels []string
+}
+
+// ListCursor position in a session list, the start time and key of the last session of the previous page
+type ListCursor struct {
+	StartTime time.Time
+	Key       string
+}
+
+// ParseListQuery returns the ListQuery of the query values limit, cursor, fields (comma separated) and label (comma
+// separated, all must match)
+func ParseListQuery(query url.Values) (*ListQuery, error) {
+	q := &ListQuery{Limit: defaultListLimit}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, fmt.Errorf("invalid limit %q, expected 1 to %d", v, maxListLimit)
+		}
+		q.Limit = limit
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := DecodeListCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		q.Cursor = cursor
+	}
+
+	for _, f := range strings.Split(query.Get("fields"), ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !apiSessionFields[f] {
+			return nil, fmt.Errorf("invalid field %q", f)
+		}
+		q.Fields = append(q.Fields, f)
+	}
+
+	for _, l := range strings.Split(query.Get("label"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			q.Labels = append(q.Labels, l)
+		}
+	}
+	return q, nil
+}
+
+// Encode returns the opaque form of the cursor passed back with ?cursor=
+func (c *ListCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%s", c.StartTime.UnixNano(), c.Key)))
+}
+
+// DecodeListCursor parses a cursor returned by Encode
+func DecodeListCursor(value string) (*ListCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", value)
+	}
+
+	nanos, key, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor %q", value)
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", value)
+	}
+	return &ListCursor{StartTime: time.Unix(0, n), Key: key}, nil
+}
+
+// after returns true if s is listed after the cursor, the list is ordered by start time newest first then by key
+func (c *ListCursor) after(s *Session) bool {
+	if s.StartTime.Equal(c.StartTime) {
+		return s.Key > c.Key
+	}
+	return s.StartTime.Before(c.StartTime)
+}
+
+// ServeSessionList writes the page of the sessions matching filter described by the query of the request. The next
+// page is linked with the X-Next-Cursor and Link headers, X-Total-Count is the number of matching sessions. The
+// response has a weak ETag, a request with a matching If-None-Match returns 304.
+func ServeSessionList(c *gin.Context, filter func(s *Session) bool) {
+	q, err := ParseListQuery(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(400, gin.H{"result": "failed", "code": "INVALID_LIST_QUERY", "message": err.Error()})
+		return
+	}
+
+	// read the generation first, a change while the page is built gives a new ETag on the next request
+	generation := Sessions.Generation()
+
+	list := make([]*Session, 0)
+	for _, s := range Sessions.List() {
+		if (filter == nil || filter(s)) && hasLabels(s.LabelList(), q.Labels) {
+			list = append(list, s)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].StartTime.Equal(list[j].StartTime) {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].StartTime.After(list[j].StartTime)
+	})
+
+	start := 0
+	if q.Cursor != nil {
+		start = sort.Search(len(list), func(i int) bool {
+			return q.Cursor.after(list[i])
+		})
+	}
+	page := list[start:]
+	var next *ListCursor
+	if len(page) > q.Limit {
+		page = page[:q.Limit]
+		last := page[len(page)-1]
+		next = &ListCursor{StartTime: last.StartTime, Key: last.Key}
+	}
+
+	etag := listETag(generation, c.Request.URL.RawQuery, page)
+	c.Header("ETag", etag)
+	c.Header("X-Total-Count", strconv.Itoa(len(list)))
+	if next != nil {
+		query := c.Request.URL.Query()
+		query.Set("cursor", next.Encode())
+		c.Header("X-Next-Cursor", next.Encode())
+		c.Header("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", c.Request.URL.Path, query.Encode()))
+	}
+
+	if match := c.GetHeader("If-None-Match"); match != "" && match == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if len(q.Fields) == 0 {
+		result := make([]*ApiSession, 0, len(page))
+		for _, s := range page {
+			result = append(result, s.ToApiSession())
+		}
+		c.JSON(200, result)
+		return
+	}
+
+	result := make([]map[string]json.RawMessage, 0, len(page))
+	for _, s := range page {
+		projected, err := selectFields(s.toApiSession(hasField(q.Fields, "size")), q.Fields)
+		if err != nil {
+			c.JSON(500, gin.H{"result": "failed", "code": "LIST_FAILED", "message": err.Error()})
+			return
+		}
+		result = append(result, projected)
+	}
+	c.JSON(200, result)
+}
+
+// listETag returns the weak ETag of a page, active sessions change without a new generation so their counters are
+// part of the tag
+func listETag(generation uint64, rawQuery string, page []*Session) string {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d|%s", generation, rawQuery)
+	for _, s := range page {
+		s.mu.RLock()
+		_, _ = fmt.Fprintf(h, "|%s:%t:%d:%d", s.Key, s.Active, s.BytesIn, s.BytesOut)
+		s.mu.RUnlock()
+	}
+	return fmt.Sprintf("W/\"%x\"", h.Sum64())
+}
+
+// selectFields returns the named json fields of the ApiSession
+func selectFields(s *ApiSession, fields []string) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]json.RawMessage)
+	err = json.Unmarshal(raw, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			selected[f] = v
+		}
+	}
+	return selected, nil
+}
+
+func hasField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldNames returns the json names of the exported fields of a struct type
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
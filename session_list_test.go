@@ -0,0 +1,89 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func getTestList(t *testing.T, url, etag string) (*http.Response, []*ApiSession) {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var list []*ApiSession
+	if res.StatusCode == http.StatusOK {
+		err = json.NewDecoder(res.Body).Decode(&list)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res, list
+}
+
+func TestSessionListDefaultLimit(t *testing.T) {
+	setupTestServer(t)
+	routerURL := serveTestRouter(t)
+
+	for i := 0; i < defaultListLimit+5; i++ {
+		_, err := createSession("127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, list := getTestList(t, routerURL+"/api/list/sessions", "")
+	if len(list) != defaultListLimit {
+		t.Errorf("got %d sessions, want %d", len(list), defaultListLimit)
+	}
+	if res.Header.Get("X-Next-Cursor") == "" {
+		t.Errorf("no next cursor")
+	}
+	if res.Header.Get("X-Total-Count") != "105" {
+		t.Errorf("total count %s", res.Header.Get("X-Total-Count"))
+	}
+}
+
+func TestSessionListETagStableOnUpdates(t *testing.T) {
+	setupTestServer(t)
+	routerURL := serveTestRouter(t)
+
+	s, err := createSession("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := getTestList(t, routerURL+"/api/list/sessions", "")
+	etag := res.Header.Get("ETag")
+
+	// the session updater broadcasts active sessions without changing them
+	Broadcast(SessionUpdated, s.ToApiSession())
+	res, _ = getTestList(t, routerURL+"/api/list/sessions", etag)
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged list returned %d", res.StatusCode)
+	}
+
+	notes := "checked"
+	err = s.Annotate(&SessionAnnotations{Notes: &notes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = getTestList(t, routerURL+"/api/list/sessions", etag)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("annotated list returned %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// SessionStore thread safe registry of all sessions known to the server. The store keeps a secondary index of the
+// search terms of every session, a term maps to the keys of the sessions that have it, see indexTerms. r.mu is taken
+// before the mutex of a session, never call the store while holding s.mu.
+type SessionStore struct {
+	mu         sync.RWMutex
+	sessions   map[string]*Session
+	postings   map[string]map[string]bool
+	terms      map[string][]string
+	generation uint64
+}
+
+// NewSessionStore create an empty SessionStore
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		postings: make(map[string]map[string]bool),
+		terms:    make(map[string][]string),
+	}
+}
+
+// Get returns the session for the key
+func (r *SessionStore) Get(key string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[key]
+	return s, ok
+}
+
+// Put adds or replaces the session under its key
+func (r *SessionStore) Put(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.Key] = s
+	r.index(s.Key, indexTerms(s))
+	r.generation++
+}
+
+// PutIfAbsent adds the session under its key, returns false if the key is already in use
+func (r *SessionStore) PutIfAbsent(s *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[s.Key]; ok {
+		return false
+	}
+	r.sessions[s.Key] = s
+	r.index(s.Key, indexTerms(s))
+	r.generation++
+	return true
+}
+
+// Reindex updates the index entries of the session, called after the indexed fields of the session change. The terms
+// are read under r.mu so two updates of the same session can not swap in their terms in the wrong order.
+func (r *SessionStore) Reindex(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[s.Key]; ok {
+		r.index(s.Key, indexTerms(s))
+		r.generation++
+	}
+}
+
+// Touch records a change to a session that is not part of the index, see Generation
+func (r *SessionStore) Touch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+}
+
+// Generation returns a counter that changes every time a session is added, removed or updated
+func (r *SessionStore) Generation() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.generation
+}
+
+// Delete removes the session for the key
+func (r *SessionStore) Delete(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, key)
+	r.index(key, nil)
+	r.generation++
+}
+
+// index replaces the terms of the key, r.mu must be held
+func (r *SessionStore) index(key string, terms []string) {
+	for _, t := range r.terms[key] {
+		delete(r.postings[t], key)
+		if len(r.postings[t]) == 0 {
+			delete(r.postings, t)
+		}
+	}
+
+	if len(terms) == 0 {
+		delete(r.terms, key)
+		return
+	}
+
+	for _, t := range terms {
+		keys, ok := r.postings[t]
+		if !ok {
+			keys = make(map[string]bool)
+			r.postings[t] = keys
+		}
+		keys[key] = true
+	}
+	r.terms[key] = terms
+}
+
+// Len returns the number of sessions
+func (r *SessionStore) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// List returns a snapshot of the sessions, sorted by start time oldest first
+func (r *SessionStore) List() []*Session {
+	r.mu.RLock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, v := range r.sessions {
+		list = append(list, v)
+	}
+	r.mu.RUnlock()
+
+	sortByStartTime(list)
+	return list
+}
+
+// Lookup returns the sessions that have every term, sorted by start time oldest first. No terms returns all sessions.
+func (r *SessionStore) Lookup(terms []string) []*Session {
+	if len(terms) == 0 {
+		return r.List()
+	}
+
+	r.mu.RLock()
+	// walk the smallest posting list and check the others
+	smallest := r.postings[terms[0]]
+	for _, t := range terms[1:] {
+		if len(r.postings[t]) < len(smallest) {
+			smallest = r.postings[t]
+		}
+	}
+
+	list := make([]*Session, 0, len(smallest))
+	for key := range smallest {
+		found := true
+		for _, t := range terms {
+			if !r.postings[t][key] {
+				found = false
+				break
+			}
+		}
+		if found {
+			list = append(list, r.sessions[key])
+		}
+	}
+	r.mu.RUnlock()
+
+	sortByStartTime(list)
+	return list
+}
+
+// Filter returns a snapshot of the sessions that match the filter, sorted by start time oldest first
+func (r *SessionStore) Filter(filter func(s *Session) bool) []*Session {
+	list := make([]*Session, 0)
+	for _, v := range r.List() {
+		if filter(v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func sortByStartTime(list []*Session) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+}
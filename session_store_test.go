@@ -0,0 +1,237 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/speps/go-hashids/v2"
+)
+
+// setupTestServer opens a bolt store in a temp save dir and resets the session registry, as main does before the
+// listeners are spawned
+func setupTestServer(t *testing.T) {
+	t.Helper()
+
+	hd := hashids.NewData()
+	hd.Salt = "dumpr salt"
+	hd.MinLength = 30
+	hasher, _ = hashids.NewWithData(hd)
+
+	*saveDir = t.TempDir()
+	maxSessionSize = 1 << 20
+	Sessions = NewSessionStore()
+	Bins = &BinStore{bins: make(map[string]*Bin)}
+
+	_, err := InitializeDB()
+	if err != nil {
+		t.Fatalf("unable to initialize db: %v", err)
+	}
+	err = InitializeAutoResponders()
+	if err != nil {
+		t.Fatalf("unable to load autoresponders: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+}
+
+// listenTestTCP accepts connections on a loopback port and serves them like a tcp listener spawned by main
+func listenTestTCP(t *testing.T, config *ListenerConfig) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleConn(client, config)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+		wg.Wait()
+	})
+	return l.Addr().String()
+}
+
+// serveTestRouter serves the gin router on a loopback port with the embedded web assets, as GinServer does
+func serveTestRouter(t *testing.T) string {
+	t.Helper()
+
+	webFS, _ = fs.Sub(webEmbedFS, "web")
+	webDirHTTPFS = http.FS(webFS)
+	staticDirHTTPFS = EmbedFolder(webFS, "assets", false)
+
+	router, err := NewRouter()
+	if err != nil {
+		t.Fatalf("unable to create router: %v", err)
+	}
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// checkStoreInvariants returns an error if the registry, its index and the stored sessions disagree
+func checkStoreInvariants() error {
+	stored := make(map[string]bool)
+	err := store.ForEachSession(func(key string, raw []byte) error {
+		stored[key] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range Sessions.List() {
+		if s.IsActive() {
+			return fmt.Errorf("session %s is still active", s.Key)
+		}
+		if !stored[s.Key] {
+			return fmt.Errorf("session %s is not stored", s.Key)
+		}
+		delete(stored, s.Key)
+
+		for _, term := range indexTerms(s) {
+			found := false
+			for _, v := range Sessions.Lookup([]string{term}) {
+				found = found || v == s
+			}
+			if !found {
+				return fmt.Errorf("session %s not found by %s", s.Key, term)
+			}
+		}
+	}
+	for key := range stored {
+		return fmt.Errorf("purged session %s is still stored", key)
+	}
+	return nil
+}
+
+// TestConcurrentCapturesAndPurges captures tcp and http sessions, on a tcp listener and through the gin router, while
+// the sessions are listed, marshalled and purged. The registry, its index and the store must agree afterwards. Run with
+// -race.
+func TestConcurrentCapturesAndPurges(t *testing.T) {
+	setupTestServer(t)
+	addr := listenTestTCP(t, &ListenerConfig{Host: "127.0.0.1"})
+	routerURL := serveTestRouter(t)
+
+	// an idle keep-alive connection would hold the listener open until the client drops it
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	post := func(url string) {
+		res, err := client.Post(url, "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Errorf("unable to post: %v", err)
+			return
+		}
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("post %s returned %d", url, res.StatusCode)
+		}
+	}
+
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("unable to dial: %v", err)
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+			for j := 0; j < 10; j++ {
+				_, _ = fmt.Fprintf(conn, "raw client %d line %d\n", i, j)
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			post(fmt.Sprintf("http://%s/capture/%d", addr, i))
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			post(fmt.Sprintf("%s/capture/%d", routerURL, i))
+		}(i)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, s := range Sessions.List() {
+				_ = s.ToApiSession()
+				_ = s.Bytes()
+				_ = s.DiskUsage()
+				_ = s.ProtocolType()
+				_, _ = s.UploadedFile("file")
+			}
+			_ = GetAllSessions()
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, s := range Sessions.List() {
+				if !s.IsActive() {
+					PurgeSession(s)
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	// the raw sessions are closed by the listener after their client hung up
+	deadline := time.Now().Add(5 * time.Second)
+	err := checkStoreInvariants()
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		err = checkStoreInvariants()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
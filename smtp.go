@@ -0,0 +1,335 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// smtpIdleTimeout how long the SMTP listener waits for the next command
+	smtpIdleTimeout = 5 * time.Minute
+
+	// maxSMTPRecipients upper bound of the recipients of a message
+	maxSMTPRecipients = 1000
+)
+
+var (
+	// errSMTPLineTooLong a command or a line of a message does not fit the read buffer
+	errSMTPLineTooLong = errors.New("line too long")
+
+	// errSMTPMessageTooBig the message is larger than the max session size, it was read and dropped
+	errSMTPMessageTooBig = errors.New("message too big")
+
+	// errSMTPSessionTooBig the dialog recorded in the connection session reached the max session size
+	errSMTPSessionTooBig = errors.New("session too big")
+)
+
+// smtpTransaction envelope of the message being received
+type smtpTransaction struct {
+	helo string
+	user string
+	mail bool
+	from string
+	to   []string
+}
+
+// serveSMTPConn speaks enough SMTP to accept mail from any sender, AUTH accepts any credentials. Every message is
+// captured in its own mail session linked to the connection session, the dialog without the messages is recorded in the
+// connection session. The connection is closed once the dialog reaches the max session size.
+func serveSMTPConn(conn *Session, client net.Conn, b *bufio.Reader) {
+	Broadcast(SessionUpdated, conn.ToApiSession())
+
+	reply := func(lines ...string) error {
+		var out bytes.Buffer
+		for _, l := range lines {
+			out.WriteString(l)
+			out.WriteString("\r\n")
+		}
+		total := conn.Record(Outbound, out.Bytes())
+		_, err := client.Write(out.Bytes())
+		if err == nil && total >= int64(maxSessionSize) {
+			err = errSMTPSessionTooBig
+		}
+		return err
+	}
+	readLine := func() (string, error) {
+		_ = client.SetReadDeadline(time.Now().Add(smtpIdleTimeout))
+		line, err := readSMTPLine(b)
+		if len(line) > 0 && conn.Record(Inbound, line) >= int64(maxSessionSize) {
+			fmt.Printf("Shuting down session: %s max session size reached: %d\n", conn.Key, maxSessionSize)
+			_, _ = client.Write([]byte("421 4.7.0 Error: session too big\r\n"))
+			return "", errSMTPSessionTooBig
+		}
+		return strings.TrimRight(string(line), "\r\n"), err
+	}
+
+	err := reply(fmt.Sprintf("220 dumpr ESMTP ready, view at %s/v/%s", *publicUrl, conn.Key))
+	if err != nil {
+		return
+	}
+
+	tx := &smtpTransaction{}
+	for {
+		line, err := readLine()
+		if err == errSMTPLineTooLong {
+			for err == errSMTPLineTooLong {
+				_, err = readLine()
+			}
+			if err != nil {
+				return
+			}
+			err = reply("500 5.5.2 Error: line too long")
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			tx = &smtpTransaction{helo: arg, user: tx.user}
+			err = reply("250 dumpr")
+		case "EHLO":
+			tx = &smtpTransaction{helo: arg, user: tx.user}
+			err = reply(
+				"250-dumpr greets "+arg,
+				"250-PIPELINING",
+				"250-8BITMIME",
+				"250-SMTPUTF8",
+				fmt.Sprintf("250-SIZE %d", maxSessionSize),
+				"250 AUTH PLAIN LOGIN",
+			)
+		case "AUTH":
+			var user string
+			var ok bool
+			user, ok, err = smtpAuth(arg, reply, readLine)
+			if err == nil && ok {
+				tx.user = user
+				err = reply("235 2.7.0 Authentication successful")
+			}
+		case "MAIL":
+			from, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				err = reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+				break
+			}
+			tx = &smtpTransaction{helo: tx.helo, user: tx.user, mail: true, from: from}
+			err = reply("250 2.1.0 Ok")
+		case "RCPT":
+			to, ok := smtpPath(arg, "TO:")
+			switch {
+			case !ok:
+				err = reply("501 5.5.4 Syntax: RCPT TO:<address>")
+			case !tx.mail:
+				err = reply("503 5.5.1 Error: need MAIL command")
+			case len(tx.to) >= maxSMTPRecipients:
+				err = reply("452 4.5.3 Error: too many recipients")
+			default:
+				tx.to = append(tx.to, to)
+				err = reply("250 2.1.5 Ok")
+			}
+		case "DATA":
+			if len(tx.to) == 0 {
+				err = reply("503 5.5.1 Error: need RCPT command")
+				break
+			}
+			err = reply("354 End data with <CR><LF>.<CR><LF>")
+			if err != nil {
+				return
+			}
+
+			var data []byte
+			data, err = readSMTPData(b)
+			if err == errSMTPMessageTooBig {
+				err = reply(fmt.Sprintf("552 5.3.4 Error: message exceeds %d bytes", maxSessionSize))
+				tx = &smtpTransaction{helo: tx.helo, user: tx.user}
+				break
+			}
+			if err != nil {
+				return
+			}
+
+			session, cerr := captureMail(conn, tx, data)
+			tx = &smtpTransaction{helo: tx.helo, user: tx.user}
+			if cerr != nil {
+				err = reply(fmt.Sprintf("451 4.3.0 Error: unable to create save file - %v", cerr))
+				break
+			}
+			err = reply(fmt.Sprintf("250 2.0.0 Ok: queued as %s", session.Key))
+		case "RSET":
+			tx = &smtpTransaction{helo: tx.helo, user: tx.user}
+			err = reply("250 2.0.0 Ok")
+		case "NOOP":
+			err = reply("250 2.0.0 Ok")
+		case "VRFY":
+			err = reply("252 2.0.0 Cannot VRFY user, but will accept message")
+		case "QUIT":
+			_ = reply("221 2.0.0 Bye")
+			return
+		default:
+			err = reply("502 5.5.2 Error: command not recognized")
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readSMTPData reads the message sent after DATA up to the line with a single dot, dot stuffing is removed. The message
+// is only kept in the mail session, a message larger than the max session size is read and dropped.
+func readSMTPData(b *bufio.Reader) ([]byte, error) {
+	var data bytes.Buffer
+	tooBig := false
+	atLineStart := true
+	for {
+		line, err := readSMTPLine(b)
+		if err != nil && err != errSMTPLineTooLong {
+			return nil, err
+		}
+
+		complete := err == nil
+		if atLineStart && complete && (string(line) == ".\r\n" || string(line) == ".\n") {
+			if tooBig {
+				return nil, errSMTPMessageTooBig
+			}
+			return data.Bytes(), nil
+		}
+		if atLineStart && bytes.HasPrefix(line, []byte(".")) {
+			line = line[1:]
+		}
+		atLineStart = complete
+
+		if tooBig || data.Len()+len(line) > maxSessionSize {
+			tooBig = true
+			data.Reset()
+			continue
+		}
+		data.Write(line)
+	}
+}
+
+// readSMTPLine reads a line including its line break, a line longer than the read buffer is returned in chunks with
+// errSMTPLineTooLong
+func readSMTPLine(b *bufio.Reader) ([]byte, error) {
+	line, err := b.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return append([]byte(nil), line...), errSMTPLineTooLong
+	}
+	return append([]byte(nil), line...), err
+}
+
+// smtpPath returns the address of a MAIL FROM:<address> or RCPT TO:<address> argument, parameters after the address
+// are ignored
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+	if strings.HasPrefix(path, "<") {
+		end := strings.Index(path, ">")
+		if end < 0 {
+			return "", false
+		}
+		return path[1:end], true
+	}
+
+	path, _, _ = strings.Cut(path, " ")
+	return path, path != ""
+}
+
+// smtpAuth runs the PLAIN or LOGIN exchange and returns the user name, the password is not kept in the mail session. ok is
+// false when the exchange failed, the error reply was sent.
+func smtpAuth(arg string, reply func(lines ...string) error, readLine func() (string, error)) (user string, ok bool, err error) {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			err = reply("334 ")
+			if err != nil {
+				return "", false, err
+			}
+			initial, err = readLine()
+			if err != nil {
+				return "", false, err
+			}
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(initial))
+		if err != nil {
+			return "", false, reply("501 5.5.2 Error: invalid base64 response")
+		}
+		// authorization identity, authentication identity and password separated by NUL
+		fields := strings.Split(string(decoded), "\x00")
+		if len(fields) != 3 {
+			return "", false, reply("501 5.5.2 Error: invalid PLAIN response")
+		}
+		return fields[1], true, nil
+
+	case "LOGIN":
+		if initial == "" {
+			err = reply("334 VXNlcm5hbWU6")
+			if err != nil {
+				return "", false, err
+			}
+			initial, err = readLine()
+			if err != nil {
+				return "", false, err
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(initial))
+		if err != nil {
+			return "", false, reply("501 5.5.2 Error: invalid base64 response")
+		}
+
+		err = reply("334 UGFzc3dvcmQ6")
+		if err != nil {
+			return "", false, err
+		}
+		_, err = readLine()
+		if err != nil {
+			return "", false, err
+		}
+		return string(decoded), true, nil
+	}
+	return "", false, reply("504 5.5.4 Error: unsupported authentication mechanism")
+}
+
+// captureMail creates the mail session of a message received on the connection session conn
+func captureMail(conn *Session, tx *smtpTransaction, data []byte) (*Session, error) {
+	conn.mu.RLock()
+	ip, hop, tlsInfo := conn.IP, conn.HopIP, conn.TLS
+	conn.mu.RUnlock()
+
+	session, err := createSession(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	session.mu.Lock()
+	session.HopIP = hop
+	session.TLS = tlsInfo
+	session.mu.Unlock()
+	conn.AddChild(session)
+
+	session.InitializeMail(&MailMessage{Helo: tx.helo, User: tx.user, From: tx.from, To: tx.to}, data)
+	deactivateSession(session)
+	Broadcast(SessionUpdated, conn.ToApiSession())
+	return session, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpTestSessions waits for the sessions of the protocol to end and returns them
+func smtpTestSessions(t *testing.T, protocol Protocol, count int) []*Session {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var found []*Session
+		for _, s := range Sessions.List() {
+			if s.ProtocolType() == protocol && !s.IsActive() {
+				found = append(found, s)
+			}
+		}
+		if len(found) == count {
+			return found
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d %s sessions, want %d", len(found), protocol, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSMTPMessageOnlyInMailSession(t *testing.T) {
+	setupTestServer(t)
+	addr := listenTestTCP(t, &ListenerConfig{Host: "127.0.0.1", SMTP: true})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	b := bufio.NewReader(client)
+	expect := func(code string) {
+		t.Helper()
+		for {
+			line, err := b.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %s: %v", code, err)
+			}
+			if strings.HasPrefix(line, code+" ") {
+				return
+			}
+			if !strings.HasPrefix(line, code+"-") {
+				t.Fatalf("got %q, want %s", line, code)
+			}
+		}
+	}
+
+	expect("220")
+	for _, step := range [][2]string{{"EHLO test", "250"}, {"MAIL FROM:<a@example.com>", "250"}, {"RCPT TO:<b@example.com>", "250"}, {"DATA", "354"}} {
+		_, _ = fmt.Fprintf(client, "%s\r\n", step[0])
+		expect(step[1])
+	}
+	_, _ = fmt.Fprintf(client, "Subject: hi\r\n\r\nthe message body\r\n.\r\nQUIT\r\n")
+	expect("250")
+	expect("221")
+
+	conn := smtpTestSessions(t, SMTP, 1)[0]
+	mail := smtpTestSessions(t, Mail, 1)[0]
+
+	dialog, err := ReadBlob(conn.SaveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dialog), "the message body") {
+		t.Errorf("message recorded in the connection session: %q", dialog)
+	}
+	if !strings.Contains(string(dialog), "QUIT") {
+		t.Errorf("dialog not recorded: %q", dialog)
+	}
+	message, err := ReadBlob(mail.SaveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(message), "the message body") {
+		t.Errorf("message not recorded in the mail session: %q", message)
+	}
+}
+
+func TestSMTPSessionMaxSize(t *testing.T) {
+	setupTestServer(t)
+	maxSessionSize = 1024
+	addr := listenTestTCP(t, &ListenerConfig{Host: "127.0.0.1", SMTP: true})
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			_, err := fmt.Fprintf(client, "NOOP\r\n")
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	b := bufio.NewReader(client)
+	for {
+		_, err := b.ReadString('\n')
+		if err != nil {
+			break
+		}
+	}
+
+	conn := smtpTestSessions(t, SMTP, 1)[0]
+	conn.mu.RLock()
+	total := conn.BytesIn + conn.BytesOut
+	conn.mu.RUnlock()
+	if total > int64(maxSessionSize)+512 {
+		t.Errorf("connection session recorded %d bytes, max %d", total, maxSessionSize)
+	}
+}
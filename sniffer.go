@@ -0,0 +1,304 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/http2"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffTimeout how long the sniffers wait for the client to send enough bytes to classify the stream, the stream is
+	// raw tcp after that. Protocols where the server speaks first are never sent anything to sniff.
+	sniffTimeout = 2 * time.Second
+
+	// maxSniffBytes bytes of the stream the sniffers may ask for
+	maxSniffBytes = 64
+
+	// maxStreamLayers how many wrapping protocols, tls and PROXY headers, are decoded before the stream is raw tcp
+	maxStreamLayers = 4
+)
+
+// SniffResult result of a Sniffer looking at the first bytes of a stream
+type SniffResult int
+
+const (
+	// SniffNoMatch the stream is not the protocol of the sniffer
+	SniffNoMatch SniffResult = iota
+
+	// SniffNeedMore the bytes seen so far are the start of the protocol, more are needed to decide
+	SniffNeedMore
+
+	// SniffMatch the stream is the protocol of the sniffer
+	SniffMatch
+)
+
+// Sniffer recognises a protocol from the first bytes sent by the client and decodes the connections it matches
+type Sniffer struct {
+	Name   string
+	Match  func(peek []byte) SniffResult
+	Decode func(sc *StreamConn)
+}
+
+// sniffers the registered sniffers, they are tried in order
+var sniffers []*Sniffer
+
+// RegisterSniffer adds a sniffer to the registry, it is tried after the sniffers already registered
+func RegisterSniffer(sniffer *Sniffer) {
+	sniffers = append(sniffers, sniffer)
+}
+
+func init() {
+	RegisterSniffer(&Sniffer{Name: "proxy", Match: matchProxyHeader, Decode: decodeProxyHeader})
+	RegisterSniffer(&Sniffer{Name: "tls", Match: matchTLSClientHello, Decode: decodeTLS})
+	RegisterSniffer(&Sniffer{Name: "http2", Match: matchPrefix(http2.ClientPreface), Decode: decodeHTTP2})
+	RegisterSniffer(&Sniffer{Name: "http1", Match: matchPrefix(httpMethodPrefixes...), Decode: decodeHTTP1})
+	RegisterSniffer(&Sniffer{Name: "smtp", Match: matchFold("EHLO ", "HELO "), Decode: decodeSMTP})
+	RegisterSniffer(&Sniffer{Name: "redis", Match: matchRESPArray, Decode: decodeRedis})
+}
+
+// httpMethodPrefixes the start of a http/1.x request line
+var httpMethodPrefixes = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "}
+
+// proxyV2Signature the first bytes of a binary PROXY protocol v2 header
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// StreamConn a client connection of a tcp listener being classified. Reader buffers the bytes peeked by the sniffers,
+// decoders read the stream from it. Decoders of wrapping protocols replace Conn and Reader then call Serve again.
+type StreamConn struct {
+	Session *Session
+	Conn    net.Conn
+	Reader  *bufio.Reader
+	Config  *ListenerConfig
+	layers  int
+}
+
+// Serve classifies the stream and hands it to the decoder of the matching sniffer, unclassified streams are recorded as
+// raw tcp
+func (sc *StreamConn) Serve() {
+	sniffer := sc.sniff()
+	if sniffer == nil || sc.layers >= maxStreamLayers {
+		serveRaw(sc)
+		return
+	}
+	sniffer.Decode(sc)
+}
+
+// sniff peeks at the stream until a registered sniffer matches
+func (sc *StreamConn) sniff() *Sniffer {
+	return sniffStream(sc.Conn, sc.Reader, sniffers)
+}
+
+// sniffStream peeks at the stream until one of the sniffers matches, every sniffer gave up or the client stops sending
+func sniffStream(conn net.Conn, b *bufio.Reader, candidates []*Sniffer) *Sniffer {
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	n := 1
+	for {
+		_, err := b.Peek(n)
+		peek, _ := b.Peek(b.Buffered())
+
+		pending := false
+		for _, sniffer := range candidates {
+			switch sniffer.Match(peek) {
+			case SniffMatch:
+				return sniffer
+			case SniffNeedMore:
+				pending = true
+			}
+		}
+
+		if !pending || err != nil || len(peek) >= maxSniffBytes {
+			return nil
+		}
+		n = len(peek) + 1
+	}
+}
+
+// bufferedConn a connection whose reads go through the reader that buffered the sniffed bytes
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the connection, if the wrapped connection supports it
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("%T does not support half-close", c.Conn)
+}
+
+// matchPrefix returns a matcher of streams starting with one of the prefixes
+func matchPrefix(prefixes ...string) func(peek []byte) SniffResult {
+	return func(peek []byte) SniffResult {
+		result := SniffNoMatch
+		for _, prefix := range prefixes {
+			switch {
+			case bytes.HasPrefix(peek, []byte(prefix)):
+				return SniffMatch
+			case strings.HasPrefix(prefix, string(peek)):
+				result = SniffNeedMore
+			}
+		}
+		return result
+	}
+}
+
+// matchFold returns a matcher of streams starting with one of the prefixes ignoring case
+func matchFold(prefixes ...string) func(peek []byte) SniffResult {
+	match := matchPrefix(prefixes...)
+	return func(peek []byte) SniffResult {
+		return match(bytes.ToUpper(peek))
+	}
+}
+
+// matchProxyHeader matches a PROXY protocol v1 or v2 header
+func matchProxyHeader(peek []byte) SniffResult {
+	return matchPrefix("PROXY TCP4 ", "PROXY TCP6 ", "PROXY UNKNOWN", proxyV2Signature)(peek)
+}
+
+// matchTLSClientHello matches the record header of a tls handshake followed by the ClientHello message type
+func matchTLSClientHello(peek []byte) SniffResult {
+	expected := []func(b byte) bool{
+		func(b byte) bool { return b == 0x16 },
+		func(b byte) bool { return b == 0x03 },
+		func(b byte) bool { return b <= 0x04 },
+		func(b byte) bool { return true },
+		func(b byte) bool { return true },
+		func(b byte) bool { return b == 0x01 },
+	}
+	for i, ok := range expected {
+		if i >= len(peek) {
+			return SniffNeedMore
+		}
+		if !ok(peek[i]) {
+			return SniffNoMatch
+		}
+	}
+	return SniffMatch
+}
+
+// matchRESPArray matches the start of a redis command, an array header *<count>\r\n followed by a bulk string
+func matchRESPArray(peek []byte) SniffResult {
+	if len(peek) == 0 {
+		return SniffNeedMore
+	}
+	if peek[0] != '*' {
+		return SniffNoMatch
+	}
+
+	i := 1
+	for i < len(peek) && peek[i] >= '0' && peek[i] <= '9' {
+		i++
+	}
+	if i == 1 && i < len(peek) {
+		return SniffNoMatch
+	}
+	return matchPrefix("\r\n$")(peek[i:])
+}
+
+// decodeProxyHeader records a PROXY protocol header that was not honored by the listener, see acceptProxyHeader, then
+// classifies the stream that follows it
+func decodeProxyHeader(sc *StreamConn) {
+	header, err := readProxyHeader(sc.Reader)
+	if err != nil {
+		fmt.Printf("Session %s invalid proxy header: %v\n", sc.Session.Key, err)
+		serveRaw(sc)
+		return
+	}
+
+	sc.Session.Record(Inbound, header)
+	sc.layers++
+	sc.Serve()
+}
+
+// readProxyHeader reads a PROXY protocol v1 line or v2 binary header from the stream
+func readProxyHeader(b *bufio.Reader) ([]byte, error) {
+	if prefix, _ := b.Peek(len(proxyV2Signature)); string(prefix) == proxyV2Signature {
+		fixed, err := b.Peek(16)
+		if err != nil {
+			return nil, err
+		}
+		length := 16 + int(fixed[14])<<8 + int(fixed[15])
+		header, err := b.Peek(length)
+		if err != nil {
+			return nil, err
+		}
+		header = append([]byte(nil), header...)
+		_, err = b.Discard(length)
+		return header, err
+	}
+
+	// a v1 header is a single line of at most 107 bytes including the crlf
+	line, err := b.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return append([]byte(nil), line...), nil
+}
+
+// decodeTLS terminates the tls connection with the configured certificate then classifies the decrypted stream
+func decodeTLS(sc *StreamConn) {
+	config, err := tlsServerConfig()
+	if err != nil {
+		fmt.Printf("Session %s unable to load the tls certificate: %v\n", sc.Session.Key, err)
+		serveRaw(sc)
+		return
+	}
+
+	tc := newTLSConn(&bufferedConn{Conn: sc.Conn, r: sc.Reader}, config)
+	sc.Session.SetProtocol(TLS)
+	info, err := tc.Info()
+	sc.Session.mu.Lock()
+	sc.Session.TLS = info
+	sc.Session.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Session %s tls handshake failed: %v\n", sc.Session.Key, err)
+		return
+	}
+
+	sc.Conn = tc
+	sc.Reader = bufio.NewReader(tc)
+	sc.layers++
+	sc.Serve()
+}
+
+func decodeHTTP1(sc *StreamConn) {
+	sc.Session.SetProtocol(HTTP1)
+	serveHTTPConn(sc.Session, sc.Conn, sc.Reader)
+}
+
+func decodeHTTP2(sc *StreamConn) {
+	sc.Session.SetProtocol(HTTP2)
+	serveHTTP2Conn(sc.Session, &bufferedConn{Conn: sc.Conn, r: sc.Reader})
+}
+
+// decodeSMTP serves a smtp client, a client detected by the sniffer did not wait for the greeting, it is sent before the
+// replies to the commands already received
+func decodeSMTP(sc *StreamConn) {
+	sc.Session.SetProtocol(SMTP)
+	serveSMTPConn(sc.Session, sc.Conn, sc.Reader)
+}
+
+func decodeRedis(sc *StreamConn) {
+	sc.Session.SetProtocol(Redis)
+	serveRedisConn(sc.Session, sc.Conn, sc.Reader)
+}
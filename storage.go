@@ -0,0 +1,122 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound returned by the storage backends when a key or blob does not exist
+var ErrNotFound = errors.New("not found")
+
+// SessionMetaStore persists the json metadata of the sessions, keyed by session key
+type SessionMetaStore interface {
+	PutSession(key string, raw []byte) error
+	GetSession(key string) ([]byte, error)
+	DeleteSession(key string) error
+	// ForEachSession calls fn for every stored session in key order. fn may call back into the store.
+	ForEachSession(fn func(key string, raw []byte) error) error
+}
+
+// ResponderStore persists the json definitions of the global autoresponders, keyed by responder name
+type ResponderStore interface {
+	PutResponder(name string, raw []byte) error
+	GetResponder(name string) ([]byte, error)
+	DeleteResponder(name string) error
+	// ForEachResponder calls fn for every stored responder in name order. fn may call back into the store.
+	ForEachResponder(fn func(name string, raw []byte) error) error
+}
+
+// RecordStore persists the json records of the other subsystems, grouped by bucket: BinsBucket, AuthBucket and
+// MetaBucket.
+type RecordStore interface {
+	PutRecord(bucket, key string, raw []byte) error
+	GetRecord(bucket, key string) ([]byte, error)
+	DeleteRecord(bucket, key string) error
+	// ForEachRecord calls fn for every record of the bucket in key order. fn may call back into the store.
+	ForEachRecord(bucket string, fn func(key string, raw []byte) error) error
+}
+
+// BlobStore persists the payloads of the sessions: the raw capture, frames, uploaded files and resend results. Blobs
+// are named by the paths recorded in the session metadata.
+type BlobStore interface {
+	// Create creates a new blob, it is an error if the blob exists. Data written is readable before Close.
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Size(name string) (int64, error)
+	Remove(name string) error
+	// List calls fn for every blob in name order
+	List(fn func(name string, size int64) error) error
+}
+
+// Storage a storage backend, selected with --storage
+type Storage interface {
+	SessionMetaStore
+	ResponderStore
+	RecordStore
+	Blobs() BlobStore
+	Name() string
+	// Compact rewrites the backend files to reclaim the space of deleted entries, returns the size before and after
+	Compact() (int64, int64, error)
+	Close() error
+}
+
+// StorageBackends the names of the available storage backends
+var StorageBackends = []string{"bolt", "sqlite"}
+
+// OpenStorage opens the named storage backend with its files in dir
+func OpenStorage(backend, dir string) (Storage, error) {
+	switch backend {
+	case "bolt":
+		return OpenBoltStorage(dir)
+	case "sqlite":
+		return OpenSQLiteStorage(dir)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected one of %v", backend, StorageBackends)
+}
+
+// BlobExists returns true if the blob exists in the storage backend
+func BlobExists(name string) bool {
+	if name == "" || store == nil {
+		return false
+	}
+	_, err := store.Blobs().Size(name)
+	return err == nil
+}
+
+// ReadBlob returns the content of a blob
+func ReadBlob(name string) ([]byte, error) {
+	r, err := store.Blobs().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
+
+// WriteBlob creates a blob with the content of data
+func WriteBlob(name string, data []byte) error {
+	return WriteBlobTo(store.Blobs(), name, data)
+}
+
+// WriteBlobTo creates a blob of the blob store with the content of data
+func WriteBlobTo(blobs BlobStore, name string, data []byte) error {
+	w, err := blobs.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, bytes.NewReader(data))
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
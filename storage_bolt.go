@@ -0,0 +1,319 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// BoltStorage the default storage backend, metadata in the buckets of dumpr.db and the session payloads as files in
+// --saveDir.
+type BoltStorage struct {
+	db    *bolt.DB
+	blobs *FileBlobStore
+}
+
+// OpenBoltStorage opens or creates dumpr.db in dir
+func OpenBoltStorage(dir string) (*BoltStorage, error) {
+	_ = os.MkdirAll(dir, 0777)
+	filename := fmt.Sprintf("%s/dumpr.db", dir)
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{
+		Timeout: 5 * time.Second,
+	})
+	if errors.Is(err, bolt.ErrTimeout) {
+		// bolt holds an exclusive lock on the file while it is open
+		return nil, fmt.Errorf("%s is in use by another dumpr process, stop the server or use its api: %w", filename, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{SessionBucket, RespondersBucket, BinsBucket, AuthBucket, MetaBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	fmt.Printf("Opened %s data file\n", filename)
+	return &BoltStorage{db: db, blobs: &FileBlobStore{dir: dir}}, nil
+}
+
+// Name returns the name of the backend
+func (s *BoltStorage) Name() string {
+	return "bolt"
+}
+
+// Close closes dumpr.db
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// Compact copies every bucket to a new dumpr.db, bolt never shrinks the file it was given
+func (s *BoltStorage) Compact() (int64, int64, error) {
+	path := s.db.Path()
+	before := fileSize(path)
+
+	tmp := path + ".compact"
+	_ = os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return before, before, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return dst.Update(func(dtx *bolt.Tx) error {
+				copied, err := dtx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				return b.ForEach(copied.Put)
+			})
+		})
+	})
+	_ = dst.Close()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return before, before, err
+	}
+
+	err = s.db.Close()
+	if err != nil {
+		return before, before, err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return before, before, err
+	}
+
+	s.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	return before, fileSize(path), err
+}
+
+// Blobs returns the file backed blob store
+func (s *BoltStorage) Blobs() BlobStore {
+	return s.blobs
+}
+
+// PutSession store the session metadata in the SessionBucket
+func (s *BoltStorage) PutSession(key string, raw []byte) error {
+	return s.PutRecord(SessionBucket, key, raw)
+}
+
+// GetSession returns the session metadata from the SessionBucket
+func (s *BoltStorage) GetSession(key string) ([]byte, error) {
+	return s.GetRecord(SessionBucket, key)
+}
+
+// DeleteSession deletes the session metadata from the SessionBucket
+func (s *BoltStorage) DeleteSession(key string) error {
+	return s.DeleteRecord(SessionBucket, key)
+}
+
+// ForEachSession calls fn for every entry of the SessionBucket
+func (s *BoltStorage) ForEachSession(fn func(key string, raw []byte) error) error {
+	return s.ForEachRecord(SessionBucket, fn)
+}
+
+// PutResponder store the responder in the RespondersBucket
+func (s *BoltStorage) PutResponder(name string, raw []byte) error {
+	return s.PutRecord(RespondersBucket, name, raw)
+}
+
+// GetResponder returns the responder from the RespondersBucket
+func (s *BoltStorage) GetResponder(name string) ([]byte, error) {
+	return s.GetRecord(RespondersBucket, name)
+}
+
+// DeleteResponder deletes the responder from the RespondersBucket
+func (s *BoltStorage) DeleteResponder(name string) error {
+	return s.DeleteRecord(RespondersBucket, name)
+}
+
+// ForEachResponder calls fn for every entry of the RespondersBucket
+func (s *BoltStorage) ForEachResponder(fn func(name string, raw []byte) error) error {
+	return s.ForEachRecord(RespondersBucket, fn)
+}
+
+// PutRecord store a record in a bucket
+func (s *BoltStorage) PutRecord(bucket, key string, raw []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s: %w", bucket, ErrNotFound)
+		}
+		return b.Put([]byte(key), raw)
+	})
+}
+
+// GetRecord returns a copy of a record of a bucket
+func (s *BoltStorage) GetRecord(bucket, key string) (raw []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		raw = append([]byte(nil), v...)
+		return nil
+	})
+	return raw, err
+}
+
+// DeleteRecord deletes a record of a bucket, deleting a missing record is not an error
+func (s *BoltStorage) DeleteRecord(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEachRecord calls fn for every record of a bucket. The records are copied out of the read transaction first so fn
+// may update the db.
+func (s *BoltStorage) ForEachRecord(bucket string, fn func(key string, raw []byte) error) error {
+	type record struct {
+		key string
+		raw []byte
+	}
+
+	records := make([]record, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			records = append(records, record{key: string(k), raw: append([]byte(nil), v...)})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		err = fn(r.key, r.raw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileBlobStore stores blobs as files, the blob name is the file path. Sessions are saved in the date directories of
+// dir.
+type FileBlobStore struct {
+	dir string
+}
+
+// Create creates the file and its directory, it is an error if the file exists
+func (f *FileBlobStore) Create(name string) (io.WriteCloser, error) {
+	_ = os.MkdirAll(filepath.Dir(name), 0777)
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// Open opens the file for reading
+func (f *FileBlobStore) Open(name string) (io.ReadCloser, error) {
+	r, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return r, err
+}
+
+// Size returns the size of the file
+func (f *FileBlobStore) Size(name string) (int64, error) {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Remove removes the file, the directory of the uploaded files of a session is removed once empty
+func (f *FileBlobStore) Remove(name string) error {
+	err := os.Remove(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(name); filepath.Ext(dir) == ".files" {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+// List walks the <date> directories of the save directory
+func (f *FileBlobStore) List(fn func(name string, size int64) error) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || !sessionDateDir.MatchString(e.Name()) {
+			continue
+		}
+
+		root := fmt.Sprintf("%s/%s", f.dir, e.Name())
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			return fn(fmt.Sprintf("%s/%s", root, filepath.ToSlash(rel)), info.Size())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionDateDir the directories sessions are saved in, named by the start date of the session
+var sessionDateDir = regexp.MustCompile(`^[0-9]{8}$`)
+
+func fileSize(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
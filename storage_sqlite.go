@@ -0,0 +1,518 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	// registers the pure go sqlite database/sql driver, the release binaries are built without cgo
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema tables of the sqlite backend. Sessions and responders have their own tables, the other subsystems share
+// the records table. Blobs are stored in chunks of up to sqliteChunkSize.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (key TEXT PRIMARY KEY, data BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS responders (name TEXT PRIMARY KEY, data BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS records (bucket TEXT NOT NULL, key TEXT NOT NULL, data BLOB NOT NULL, PRIMARY KEY (bucket, key));
+CREATE TABLE IF NOT EXISTS blobs (name TEXT PRIMARY KEY, size INTEGER NOT NULL DEFAULT 0);
+CREATE TABLE IF NOT EXISTS blob_chunks (name TEXT NOT NULL, seq INTEGER NOT NULL, data BLOB NOT NULL, PRIMARY KEY (name, seq));
+`
+
+// SQLiteStorage storage backend keeping the metadata and the session payloads in a single dumpr.sqlite file
+type SQLiteStorage struct {
+	db    *sql.DB
+	file  string
+	blobs *sqliteBlobStore
+}
+
+// OpenSQLiteStorage opens or creates dumpr.sqlite in dir
+func OpenSQLiteStorage(dir string) (*SQLiteStorage, error) {
+	_ = os.MkdirAll(dir, 0777)
+	filename := fmt.Sprintf("%s/dumpr.sqlite", dir)
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", filename))
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writers, sqlite allows one at a time
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("unable to open %s: %v", filename, err)
+	}
+
+	fmt.Printf("Opened %s data file\n", filename)
+	blobs := &sqliteBlobStore{db: db, writers: make(map[string]*sqliteBlobWriter)}
+	return &SQLiteStorage{db: db, file: filename, blobs: blobs}, nil
+}
+
+// Name returns the name of the backend
+func (s *SQLiteStorage) Name() string {
+	return "sqlite"
+}
+
+// Close commits the buffered blob writes and closes dumpr.sqlite
+func (s *SQLiteStorage) Close() error {
+	err := s.blobs.flushAll()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Compact checkpoints the write ahead log and vacuums dumpr.sqlite
+func (s *SQLiteStorage) Compact() (int64, int64, error) {
+	before := fileSize(s.file) + fileSize(s.file+"-wal")
+	_, err := s.db.Exec("VACUUM")
+	if err == nil {
+		_, err = s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	}
+	return before, fileSize(s.file) + fileSize(s.file+"-wal"), err
+}
+
+// Blobs returns the blob store kept in the blobs tables
+func (s *SQLiteStorage) Blobs() BlobStore {
+	return s.blobs
+}
+
+// PutSession store the session metadata
+func (s *SQLiteStorage) PutSession(key string, raw []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO sessions (key, data) VALUES (?, ?)", key, raw)
+	return err
+}
+
+// GetSession returns the session metadata
+func (s *SQLiteStorage) GetSession(key string) ([]byte, error) {
+	return s.get("SELECT data FROM sessions WHERE key = ?", key)
+}
+
+// DeleteSession deletes the session metadata
+func (s *SQLiteStorage) DeleteSession(key string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE key = ?", key)
+	return err
+}
+
+// ForEachSession calls fn for every stored session
+func (s *SQLiteStorage) ForEachSession(fn func(key string, raw []byte) error) error {
+	return s.forEach(fn, "SELECT key, data FROM sessions ORDER BY key")
+}
+
+// PutResponder store the responder
+func (s *SQLiteStorage) PutResponder(name string, raw []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO responders (name, data) VALUES (?, ?)", name, raw)
+	return err
+}
+
+// GetResponder returns the responder
+func (s *SQLiteStorage) GetResponder(name string) ([]byte, error) {
+	return s.get("SELECT data FROM responders WHERE name = ?", name)
+}
+
+// DeleteResponder deletes the responder
+func (s *SQLiteStorage) DeleteResponder(name string) error {
+	_, err := s.db.Exec("DELETE FROM responders WHERE name = ?", name)
+	return err
+}
+
+// ForEachResponder calls fn for every stored responder
+func (s *SQLiteStorage) ForEachResponder(fn func(name string, raw []byte) error) error {
+	return s.forEach(fn, "SELECT name, data FROM responders ORDER BY name")
+}
+
+// PutRecord store a record in a bucket
+func (s *SQLiteStorage) PutRecord(bucket, key string, raw []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO records (bucket, key, data) VALUES (?, ?, ?)", bucket, key, raw)
+	return err
+}
+
+// GetRecord returns a record of a bucket
+func (s *SQLiteStorage) GetRecord(bucket, key string) ([]byte, error) {
+	return s.get("SELECT data FROM records WHERE bucket = ? AND key = ?", bucket, key)
+}
+
+// DeleteRecord deletes a record of a bucket
+func (s *SQLiteStorage) DeleteRecord(bucket, key string) error {
+	_, err := s.db.Exec("DELETE FROM records WHERE bucket = ? AND key = ?", bucket, key)
+	return err
+}
+
+// ForEachRecord calls fn for every record of a bucket
+func (s *SQLiteStorage) ForEachRecord(bucket string, fn func(key string, raw []byte) error) error {
+	return s.forEach(fn, "SELECT key, data FROM records WHERE bucket = ? ORDER BY key", bucket)
+}
+
+func (s *SQLiteStorage) get(query string, args ...interface{}) ([]byte, error) {
+	var raw []byte
+	err := s.db.QueryRow(query, args...).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return raw, err
+}
+
+// forEach reads all rows before calling fn, the single connection is busy until the rows are closed
+func (s *SQLiteStorage) forEach(fn func(key string, raw []byte) error, query string, args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	for rows.Next() {
+		var key string
+		var raw []byte
+		err = rows.Scan(&key, &raw)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, raw)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		err = fn(key, values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteChunkSize size of the rows a blob is stored in, the writes to a blob are buffered up to a chunk
+const sqliteChunkSize = 64 * 1024
+
+// sqliteBlobReadAhead chunks read by each query of a blob reader
+const sqliteBlobReadAhead = 16
+
+type sqliteBlobStore struct {
+	db      *sql.DB
+	mu      sync.Mutex
+	writers map[string]*sqliteBlobWriter
+}
+
+// Create inserts the blob, it is an error if the blob exists
+func (b *sqliteBlobStore) Create(name string) (io.WriteCloser, error) {
+	_, err := b.db.Exec("INSERT INTO blobs (name, size) VALUES (?, 0)", name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create blob %s: %v", name, err)
+	}
+
+	w := &sqliteBlobWriter{store: b, name: name}
+	b.mu.Lock()
+	b.writers[name] = w
+	b.mu.Unlock()
+	return w, nil
+}
+
+// flush commits the buffered writes of the blob if it is open for writing, so readers see everything written
+func (b *sqliteBlobStore) flush(name string) error {
+	b.mu.Lock()
+	w := b.writers[name]
+	b.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	return w.Flush()
+}
+
+// flushAll commits the buffered writes of every blob open for writing
+func (b *sqliteBlobStore) flushAll() error {
+	b.mu.Lock()
+	writers := make([]*sqliteBlobWriter, 0, len(b.writers))
+	for _, w := range b.writers {
+		writers = append(writers, w)
+	}
+	b.mu.Unlock()
+
+	var err error
+	for _, w := range writers {
+		if ferr := w.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// Open returns a reader of the chunks of the blob, the chunks are queried as they are read and no connection is held
+// in between
+func (b *sqliteBlobStore) Open(name string) (io.ReadCloser, error) {
+	err := b.flush(name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.Size(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBlobReader{store: b, name: name, next: 0}, nil
+}
+
+// Size returns the size of the blob, including the writes still buffered
+func (b *sqliteBlobStore) Size(name string) (int64, error) {
+	err := b.flush(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = b.db.QueryRow("SELECT size FROM blobs WHERE name = ?", name).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return size, err
+}
+
+// Remove deletes the blob and its chunks
+func (b *sqliteBlobStore) Remove(name string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM blobs WHERE name = ?", name)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM blob_chunks WHERE name = ?", name)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return nil
+}
+
+// List returns the blobs in name order
+func (b *sqliteBlobStore) List(fn func(name string, size int64) error) error {
+	err := b.flushAll()
+	if err != nil {
+		return err
+	}
+
+	rows, err := b.db.Query("SELECT name, size FROM blobs ORDER BY name")
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	sizes := make([]int64, 0)
+	for rows.Next() {
+		var name string
+		var size int64
+		err = rows.Scan(&name, &size)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		names = append(names, name)
+		sizes = append(sizes, size)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		err = fn(name, sizes[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteBlobReader reads the chunks of a blob in order, a few at a time
+type sqliteBlobReader struct {
+	store  *sqliteBlobStore
+	name   string
+	next   int64
+	chunks [][]byte
+	closed bool
+}
+
+// Read returns the data of the next chunks, chunks added while the blob is read are returned as well
+func (r *sqliteBlobReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+
+	for len(r.chunks) == 0 {
+		err := r.store.flush(r.name)
+		if err != nil {
+			return 0, err
+		}
+		err = r.fetch()
+		if err != nil {
+			return 0, err
+		}
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func (r *sqliteBlobReader) fetch() error {
+	rows, err := r.store.db.Query("SELECT seq, data FROM blob_chunks WHERE name = ? AND seq >= ? ORDER BY seq LIMIT ?", r.name, r.next, sqliteBlobReadAhead)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var seq int64
+		var chunk []byte
+		err = rows.Scan(&seq, &chunk)
+		if err != nil {
+			return err
+		}
+		r.next = seq + 1
+		if len(chunk) > 0 {
+			r.chunks = append(r.chunks, chunk)
+		}
+	}
+	return rows.Err()
+}
+
+// Close ends the reading, no connection is held by the reader
+func (r *sqliteBlobReader) Close() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	r.chunks = nil
+	return nil
+}
+
+// sqliteBlobWriter buffers the writes to a blob and appends them as chunks of up to sqliteChunkSize, when the buffer is
+// full, on Flush and on Close. Readers of the blob flush it first, see sqliteBlobStore.flush.
+type sqliteBlobWriter struct {
+	mu     sync.Mutex
+	store  *sqliteBlobStore
+	name   string
+	seq    int64
+	buf    []byte
+	closed bool
+}
+
+// Write buffers p, full chunks are committed
+func (w *sqliteBlobWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= sqliteChunkSize {
+		err := w.flushLocked(false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush commits the buffered writes
+func (w *sqliteBlobWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked(true)
+}
+
+// flushLocked commits the buffer in chunks of sqliteChunkSize in one transaction, the last partial chunk only if all is
+// set. w.mu must be held.
+func (w *sqliteBlobWriter) flushLocked(all bool) error {
+	n := len(w.buf)
+	if !all {
+		n -= n % sqliteChunkSize
+	}
+	if n == 0 {
+		return nil
+	}
+
+	tx, err := w.store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	seq := w.seq
+	for data := w.buf[:n]; len(data) > 0 && err == nil; seq++ {
+		chunk := data
+		if len(chunk) > sqliteChunkSize {
+			chunk = chunk[:sqliteChunkSize]
+		}
+		data = data[len(chunk):]
+		_, err = tx.Exec("INSERT INTO blob_chunks (name, seq, data) VALUES (?, ?, ?)", w.name, seq, chunk)
+	}
+	var res sql.Result
+	if err == nil {
+		res, err = tx.Exec("UPDATE blobs SET size = size + ? WHERE name = ?", n, w.name)
+	}
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			// the blob was removed while it was written
+			err = fmt.Errorf("%s: %w", w.name, ErrNotFound)
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	w.seq = seq
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return nil
+}
+
+// Close commits the buffered writes and closes the writer
+func (w *sqliteBlobWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
+	w.store.mu.Lock()
+	if w.store.writers[w.name] == w {
+		delete(w.store.writers, w.name)
+	}
+	w.store.mu.Unlock()
+	return w.flushLocked(true)
+}
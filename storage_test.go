@@ -0,0 +1,533 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storageCheck a single conformance check run against an empty storage backend, dir is a scratch directory for blob
+// names.
+type storageCheck struct {
+	name string
+	run  func(s Storage, dir string) error
+}
+
+// storageChecks the behavior every storage backend must share
+var storageChecks = []storageCheck{
+	{"session put/get/overwrite", checkSessionPutGet},
+	{"session delete", checkSessionDelete},
+	{"session iteration", checkSessionForEach},
+	{"responder put/get/delete", checkResponders},
+	{"records are scoped by bucket", checkRecordBuckets},
+	{"iteration callbacks may write", checkForEachReentrant},
+	{"blob create/append/read", checkBlobWrite},
+	{"blob create is exclusive", checkBlobExclusive},
+	{"blob readable while writing", checkBlobReadWhileWriting},
+	{"blob streamed while writing", checkBlobStreamWhileWriting},
+	{"blob remove", checkBlobRemove},
+	{"blob binary content", checkBlobBinary},
+	{"blob list", checkBlobList},
+}
+
+// TestStorageConformance runs the checks against every storage backend, each check gets a new backend
+func TestStorageConformance(t *testing.T) {
+	for _, backend := range StorageBackends {
+		for _, check := range storageChecks {
+			t.Run(backend+"/"+check.name, func(t *testing.T) {
+				dir := t.TempDir()
+				s, err := OpenStorage(backend, dir)
+				if err != nil {
+					t.Fatalf("unable to open %s storage: %v", backend, err)
+				}
+				defer func() {
+					_ = s.Close()
+				}()
+
+				err = check.run(s, dir)
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func expectBytes(got []byte, err error, want string) error {
+	if err != nil {
+		return err
+	}
+	if string(got) != want {
+		return fmt.Errorf("got %q, want %q", got, want)
+	}
+	return nil
+}
+
+func expectNotFound(err error) error {
+	if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("got error %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkSessionPutGet(s Storage, dir string) error {
+	err := s.PutSession("a", []byte(`{"key":"a"}`))
+	if err != nil {
+		return err
+	}
+	raw, err := s.GetSession("a")
+	if err = expectBytes(raw, err, `{"key":"a"}`); err != nil {
+		return err
+	}
+
+	err = s.PutSession("a", []byte(`{"key":"a","v":2}`))
+	if err != nil {
+		return err
+	}
+	raw, err = s.GetSession("a")
+	if err = expectBytes(raw, err, `{"key":"a","v":2}`); err != nil {
+		return err
+	}
+
+	_, err = s.GetSession("missing")
+	return expectNotFound(err)
+}
+
+func checkSessionDelete(s Storage, dir string) error {
+	err := s.PutSession("d", []byte(`{}`))
+	if err != nil {
+		return err
+	}
+
+	err = s.DeleteSession("d")
+	if err != nil {
+		return err
+	}
+	_, err = s.GetSession("d")
+	if err = expectNotFound(err); err != nil {
+		return err
+	}
+
+	// deleting a missing session is not an error
+	return s.DeleteSession("d")
+}
+
+func checkSessionForEach(s Storage, dir string) error {
+	for _, k := range []string{"it-c", "it-a", "it-b"} {
+		err := s.PutSession(k, []byte(k))
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0)
+	err := s.ForEachSession(func(key string, raw []byte) error {
+		if strings.HasPrefix(key, "it-") {
+			if key != string(raw) {
+				return fmt.Errorf("key %s has value %q", key, raw)
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if strings.Join(keys, ",") != "it-a,it-b,it-c" {
+		return fmt.Errorf("got keys %v, want them in key order", keys)
+	}
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = s.ForEachSession(func(key string, raw []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		return fmt.Errorf("callback error not returned, got %v after %d calls", err, calls)
+	}
+	return nil
+}
+
+func checkResponders(s Storage, dir string) error {
+	err := s.PutResponder("r1", []byte(`{"name":"r1"}`))
+	if err != nil {
+		return err
+	}
+	raw, err := s.GetResponder("r1")
+	if err = expectBytes(raw, err, `{"name":"r1"}`); err != nil {
+		return err
+	}
+
+	count := 0
+	err = s.ForEachResponder(func(name string, raw []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return fmt.Errorf("got %d responders, want 1", count)
+	}
+
+	_, err = s.GetSession("r1")
+	if err = expectNotFound(err); err != nil {
+		return fmt.Errorf("responder visible as a session: %v", err)
+	}
+
+	err = s.DeleteResponder("r1")
+	if err != nil {
+		return err
+	}
+	_, err = s.GetResponder("r1")
+	return expectNotFound(err)
+}
+
+func checkRecordBuckets(s Storage, dir string) error {
+	err := s.PutRecord(BinsBucket, "k", []byte("bin"))
+	if err != nil {
+		return err
+	}
+	err = s.PutRecord(AuthBucket, "k", []byte("auth"))
+	if err != nil {
+		return err
+	}
+
+	raw, err := s.GetRecord(BinsBucket, "k")
+	if err = expectBytes(raw, err, "bin"); err != nil {
+		return err
+	}
+	raw, err = s.GetRecord(AuthBucket, "k")
+	if err = expectBytes(raw, err, "auth"); err != nil {
+		return err
+	}
+	_, err = s.GetRecord(MetaBucket, "k")
+	if err = expectNotFound(err); err != nil {
+		return err
+	}
+
+	count := 0
+	err = s.ForEachRecord(BinsBucket, func(key string, raw []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return fmt.Errorf("got %d records in %s, want 1", count, BinsBucket)
+	}
+
+	err = s.DeleteRecord(BinsBucket, "k")
+	if err != nil {
+		return err
+	}
+	_, err = s.GetRecord(BinsBucket, "k")
+	if err = expectNotFound(err); err != nil {
+		return err
+	}
+	raw, err = s.GetRecord(AuthBucket, "k")
+	return expectBytes(raw, err, "auth")
+}
+
+func checkForEachReentrant(s Storage, dir string) error {
+	for _, k := range []string{"re-1", "re-2"} {
+		err := s.PutSession(k, []byte(k))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.ForEachSession(func(key string, raw []byte) error {
+		if !strings.HasPrefix(key, "re-") {
+			return nil
+		}
+		err := s.PutSession(key+"-copy", raw)
+		if err != nil {
+			return err
+		}
+		return s.DeleteSession(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	raw, err := s.GetSession("re-1-copy")
+	if err = expectBytes(raw, err, "re-1"); err != nil {
+		return err
+	}
+	_, err = s.GetSession("re-1")
+	return expectNotFound(err)
+}
+
+func checkBlobWrite(s Storage, dir string) error {
+	name := filepath.Join(dir, "20210101", "blob.raw")
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range []string{"hello ", "", "world"} {
+		_, err = w.Write([]byte(chunk))
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	size, err := s.Blobs().Size(name)
+	if err != nil {
+		return err
+	}
+	if size != 11 {
+		return fmt.Errorf("got size %d, want 11", size)
+	}
+
+	return expectBlob(s, name, "hello world")
+}
+
+func checkBlobExclusive(s Storage, dir string) error {
+	name := filepath.Join(dir, "exclusive.raw")
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	_, _ = w.Write([]byte("first"))
+	_ = w.Close()
+
+	w, err = s.Blobs().Create(name)
+	if err == nil {
+		_ = w.Close()
+		return fmt.Errorf("second create of %s succeeded", name)
+	}
+	return expectBlob(s, name, "first")
+}
+
+func checkBlobReadWhileWriting(s Storage, dir string) error {
+	name := filepath.Join(dir, "active.raw")
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	_, err = w.Write([]byte("partial"))
+	if err != nil {
+		return err
+	}
+	return expectBlob(s, name, "partial")
+}
+
+// checkBlobStreamWhileWriting a blob larger than a chunk written a line at a time is read while it is written, the
+// reader sees what was written after it was opened
+func checkBlobStreamWhileWriting(s Storage, dir string) error {
+	name := filepath.Join(dir, "large.raw")
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	var want bytes.Buffer
+	write := func(lines int) error {
+		for i := 0; i < lines; i++ {
+			line := fmt.Sprintf("line %06d %s\n", want.Len(), strings.Repeat("x", 80))
+			want.WriteString(line)
+			if _, err := w.Write([]byte(line)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = write(2000)
+	if err != nil {
+		return err
+	}
+	r, err := s.Blobs().Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	head := make([]byte, 1000)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return err
+	}
+	err = write(2000)
+	if err != nil {
+		return err
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if got := append(head, rest...); !bytes.Equal(got, want.Bytes()) {
+		return fmt.Errorf("read %d bytes while writing, want %d", len(got), want.Len())
+	}
+
+	size, err := s.Blobs().Size(name)
+	if err != nil {
+		return err
+	}
+	if size != int64(want.Len()) {
+		return fmt.Errorf("size %d, want %d", size, want.Len())
+	}
+	return nil
+}
+
+func checkBlobRemove(s Storage, dir string) error {
+	name := filepath.Join(dir, "key.files", "upload.txt")
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	_ = w.Close()
+
+	err = s.Blobs().Remove(name)
+	if err != nil {
+		return err
+	}
+	_, err = s.Blobs().Size(name)
+	if err = expectNotFound(err); err != nil {
+		return err
+	}
+	_, err = s.Blobs().Open(name)
+	if err = expectNotFound(err); err != nil {
+		return err
+	}
+	return expectNotFound(s.Blobs().Remove(name))
+}
+
+func checkBlobBinary(s Storage, dir string) error {
+	name := filepath.Join(dir, "binary.frames")
+	data := make([]byte, 256*3)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	w, err := s.Blobs().Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	_ = w.Close()
+
+	r, err := s.Blobs().Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("binary content changed, got %d bytes", len(got))
+	}
+	return nil
+}
+
+func expectBlob(s Storage, name, want string) error {
+	r, err := s.Blobs().Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	return expectBytes(got, err, want)
+}
+
+func checkBlobList(s Storage, dir string) error {
+	names := []string{filepath.Join(dir, "20210102", "list.raw"), filepath.Join(dir, "20210102", "list.files", "a.txt")}
+	for _, name := range names {
+		err := WriteBlobTo(s.Blobs(), name, []byte("abc"))
+		if err != nil {
+			return err
+		}
+	}
+
+	found := 0
+	err := s.Blobs().List(func(name string, size int64) error {
+		for _, n := range names {
+			if n == name {
+				if size != 3 {
+					return fmt.Errorf("%s got size %d, want 3", name, size)
+				}
+				found++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if found != len(names) {
+		return fmt.Errorf("listed %d of %d blobs", found, len(names))
+	}
+	return nil
+}
+
+// TestSQLiteBlobChunks small writes are stored in chunks of sqliteChunkSize
+func TestSQLiteBlobChunks(t *testing.T) {
+	s, err := OpenSQLiteStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	w, err := s.Blobs().Create("capture.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	const lines = 2000
+	for i := 0; i < lines; i++ {
+		_, err = w.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM blob_chunks WHERE name = ?", "capture.raw").Scan(&chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (lines*len(line) + sqliteChunkSize - 1) / sqliteChunkSize; chunks > want+1 {
+		t.Errorf("%d writes stored in %d chunks, want about %d", lines, chunks, want)
+	}
+}
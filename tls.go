@@ -0,0 +1,194 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSInfo struct to store details of the tls handshake of a session
+type TLSInfo struct {
+	ServerName         string   `json:"serverName"`
+	OfferedProtocols   []string `json:"offeredProtocols"`
+	OfferedCiphers     []string `json:"offeredCiphers"`
+	OfferedVersions    []string `json:"offeredVersions"`
+	NegotiatedProtocol string   `json:"negotiatedProtocol"`
+	CipherSuite        string   `json:"cipherSuite"`
+	Version            string   `json:"version"`
+	HandshakeError     string   `json:"handshakeError,omitempty"`
+}
+
+// tlsConn wraps a tls.Conn and keeps the details of the ClientHello sent by the client
+type tlsConn struct {
+	*tls.Conn
+	info *TLSInfo
+}
+
+// Info performs the handshake if needed and returns the details of the tls connection
+func (c *tlsConn) Info() (*TLSInfo, error) {
+	err := c.Handshake()
+	if err != nil {
+		c.info.HandshakeError = err.Error()
+		return c.info, err
+	}
+
+	state := c.ConnectionState()
+	c.info.NegotiatedProtocol = state.NegotiatedProtocol
+	c.info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	c.info.Version = tlsVersionName(state.Version)
+	if state.ServerName != "" {
+		c.info.ServerName = state.ServerName
+	}
+	return c.info, nil
+}
+
+// newTLSConn wraps the client with a tls server connection that keeps the details of the ClientHello
+func newTLSConn(client net.Conn, serverConfig *tls.Config) *tlsConn {
+	info := &TLSInfo{}
+	config := serverConfig.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		info.ServerName = hello.ServerName
+		info.OfferedProtocols = hello.SupportedProtos
+		for _, id := range hello.CipherSuites {
+			info.OfferedCiphers = append(info.OfferedCiphers, tls.CipherSuiteName(id))
+		}
+		for _, v := range hello.SupportedVersions {
+			info.OfferedVersions = append(info.OfferedVersions, tlsVersionName(v))
+		}
+		return nil, nil
+	}
+
+	return &tlsConn{Conn: tls.Server(client, config), info: info}
+}
+
+var (
+	tlsConfigOnce sync.Once
+	tlsConfig     *tls.Config
+	tlsConfigErr  error
+)
+
+// tlsServerConfig returns the server config of the configured certificate, it is loaded on first use. It is shared by
+// the tls listeners and the tls connections detected on plain listeners.
+func tlsServerConfig() (*tls.Config, error) {
+	tlsConfigOnce.Do(func() {
+		cert, err := LoadCertificate(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			tlsConfigErr = err
+			return
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	})
+	return tlsConfig, tlsConfigErr
+}
+
+// LoadCertificate loads the certificate and key from disk. If no files are set, a self-signed certificate is
+// loaded from --saveDir, it will be created on first use.
+func LoadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	certFile = fmt.Sprintf("%s/dumpr-tls.crt", *saveDir)
+	keyFile = fmt.Sprintf("%s/dumpr-tls.key", *saveDir)
+
+	if FileExists(certFile) && FileExists(keyFile) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err == nil && time.Now().Before(leaf.NotAfter) {
+				return cert, nil
+			}
+		}
+		fmt.Printf("Regenerating self-signed certificate %s\n", certFile)
+	}
+
+	err := createSelfSignedCertificate(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	fmt.Printf("Created self-signed certificate %s\n", certFile)
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+func createSelfSignedCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"dumpr!"}, CommonName: "dumpr"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	u, err := url.Parse(*publicUrl)
+	if err == nil && u.Hostname() != "" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, u.Hostname(), fmt.Sprintf("*.%s", u.Hostname()))
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	_ = os.MkdirAll(*saveDir, 0777)
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDatagramSize largest udp payload
+const maxDatagramSize = 64 * 1024
+
+// udpSource the session of a source address and the time its last datagram was received
+type udpSource struct {
+	session *Session
+	last    time.Time
+}
+
+// udpListener groups the datagrams received on a udp port by source address
+type udpListener struct {
+	conn        *net.UDPConn
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*udpSource
+}
+
+// SpawnUDPListener spawn a udp listener for the config, the datagrams of a source address are recorded in a session
+// that is shut down once the source is idle for idleTimeout. Nothing is sent back to the source.
+func SpawnUDPListener(config *ListenerConfig, idleTimeout time.Duration) error {
+	fmt.Printf("spawn: %s\n", config)
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", config.Host, config.Port))
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		fmt.Println("Error listening:", err.Error())
+		return err
+	}
+
+	l := &udpListener{conn: conn, idleTimeout: idleTimeout, sources: make(map[string]*udpSource)}
+	go l.serve()
+	go l.reapIdle()
+	return nil
+}
+
+func (l *udpListener) serve() {
+	defer func() {
+		_ = l.conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Printf("couldn't read datagram: %v\n", err)
+			continue
+		}
+		l.record(addr, buf[:n])
+	}
+}
+
+// record appends the datagram to the session of its source, a new session is created for the first datagram of a
+// source or once the previous session was shut down
+func (l *udpListener) record(addr *net.UDPAddr, pay []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	source := addr.String()
+	src, ok := l.sources[source]
+	if !ok || !src.session.IsActive() {
+		session, err := createSession(addr.IP.String())
+		if err != nil {
+			fmt.Printf("Unable to create session for datagram from %s: %v\n", source, err)
+			return
+		}
+		session.SetProtocol(UDP)
+		Broadcast(SessionUpdated, session.ToApiSession())
+		src = &udpSource{session: session}
+		l.sources[source] = src
+	}
+
+	src.last = time.Now()
+	session := src.session
+	session.mu.Lock()
+	session.Datagrams++
+	session.mu.Unlock()
+
+	if session.Record(Inbound, pay) >= int64(maxSessionSize) {
+		fmt.Printf("Shuting down session: %s max session size reached: %d\n", session.Key, maxSessionSize)
+		delete(l.sources, source)
+		deactivateSession(session)
+	}
+}
+
+// reapIdle shuts down the sessions of the sources that did not send a datagram for the idle timeout
+func (l *udpListener) reapIdle() {
+	interval := l.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		var idle []*Session
+		l.mu.Lock()
+		for source, src := range l.sources {
+			switch {
+			case !src.session.IsActive():
+				delete(l.sources, source)
+			case time.Since(src.last) >= l.idleTimeout:
+				idle = append(idle, src.session)
+				delete(l.sources, source)
+			}
+		}
+		l.mu.Unlock()
+
+		for _, session := range idle {
+			deactivateSession(session)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginCookie name of the cookie holding the web ui login
+const loginCookie = "dumpr_login"
+
+// loginTTL how long a web ui login is valid
+const loginTTL = 24 * time.Hour
+
+// binSecretCookie prefix of the cookies holding bin secrets, followed by the bin name
+const binSecretCookie = "dumpr_bin_"
+
+// Identity the user or api token a request was authenticated as
+type Identity struct {
+	Name string
+	Role Role
+}
+
+type login struct {
+	identity *Identity
+	expires  time.Time
+}
+
+var (
+	loginsMu sync.Mutex
+	logins   = make(map[string]*login)
+)
+
+// publicRoutes routes that never require auth, the capture endpoints and static assets
+var publicRoutes = map[string]bool{
+	"":                  true,
+	"/b/:bin":           true,
+	"/b/:bin/*path":     true,
+	"/favicon.ico":      true,
+	"/dumpr.png":        true,
+	"/assets/*filepath": true,
+	"/login":            true,
+	"/logout":           true,
+}
+
+// binRoutes read routes scoped to a single bin, a bin secret grants access
+var binRoutes = map[string]bool{
+	"/bins/:bin":                   true,
+	"/api/bins/:bin":               true,
+	"/api/bins/:bin/list/sessions": true,
+	"/api/bins/:bin/list/active":   true,
+	"/api/bins/:bin/list/inactive": true,
+	"/api/bins/:bin/stream":        true,
+}
+
+// requiredRole returns the role needed for the route of the request
+func requiredRole(c *gin.Context) Role {
+	path := c.FullPath()
+	if publicRoutes[path] {
+		return RoleNone
+	}
+
+	if strings.HasPrefix(path, "/api/auth/") {
+		return RoleAdmin
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleRead
+	}
+	return RoleAdmin
+}
+
+// requestBin returns the bin a read request is scoped to, the bin of the route or of the session named in the route
+func requestBin(c *gin.Context) string {
+	if binRoutes[c.FullPath()] {
+		return strings.ToLower(c.Param("bin"))
+	}
+
+	name := c.Param("name")
+	if name == "" {
+		return ""
+	}
+	session, ok := Sessions.Get(name)
+	if !ok {
+		return ""
+	}
+	return session.BinName()
+}
+
+// AuthMiddleware enforces the roles of the routes when --auth is enabled. Requests are authenticated by the web ui
+// login cookie, an api token (Authorization: Bearer, X-Api-Token header or token query param) or basic auth. Read
+// requests scoped to a bin are also allowed with the bin secret (X-Bin-Secret header, secret query param or cookie).
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !*authEnabled {
+			return
+		}
+
+		required := requiredRole(c)
+		if required == RoleNone {
+			return
+		}
+
+		identity := authenticate(c)
+		if identity != nil {
+			c.Set("identity", identity)
+			if identity.Role.Allows(required) {
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": "FORBIDDEN", "message": fmt.Sprintf("%s role required", required)})
+			return
+		}
+
+		if required == RoleRead && checkBinSecret(c, requestBin(c)) {
+			return
+		}
+
+		if c.Request.Method == http.MethodGet && !strings.HasPrefix(c.FullPath(), "/api/") && !strings.HasPrefix(c.FullPath(), "/t/") && !strings.HasSuffix(c.FullPath(), "/ws") {
+			c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+
+		c.Header("WWW-Authenticate", `Basic realm="dumpr"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": "UNAUTHORIZED", "message": "authentication required"})
+	}
+}
+
+// authenticate returns the identity of the request or nil if it carries no valid credentials
+func authenticate(c *gin.Context) *Identity {
+	if id, err := c.Cookie(loginCookie); err == nil {
+		loginsMu.Lock()
+		l, ok := logins[id]
+		if ok && time.Now().After(l.expires) {
+			delete(logins, id)
+			ok = false
+		}
+		loginsMu.Unlock()
+		if ok {
+			return l.identity
+		}
+	}
+
+	token := c.GetHeader("X-Api-Token")
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		token = c.Query("token")
+	}
+	if token != "" {
+		if t, ok := Auth.Token(token); ok {
+			return &Identity{Name: t.Name, Role: t.Role}
+		}
+		return nil
+	}
+
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		if user, ok := Auth.Login(name, password); ok {
+			return &Identity{Name: user.Name, Role: user.Role}
+		}
+	}
+	return nil
+}
+
+// checkBinSecret returns true if the request carries the secret of the bin, a secret passed as query param is kept in
+// a cookie so the pages and streams of the bin keep working.
+func checkBinSecret(c *gin.Context, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	bin, ok := Bins.Get(name)
+	if !ok {
+		return false
+	}
+
+	if bin.CheckSecret(c.GetHeader("X-Bin-Secret")) {
+		return true
+	}
+
+	if secret := c.Query("secret"); bin.CheckSecret(secret) {
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(binSecretCookie+bin.Name, secret, int(loginTTL.Seconds()), "/", "", secureCookies(c), true)
+		return true
+	}
+
+	secret, err := c.Cookie(binSecretCookie + bin.Name)
+	return err == nil && bin.CheckSecret(secret)
+}
+
+// secureCookies returns true if the web ui is served over tls, directly or behind a https --publicUrl, the auth cookies
+// are only sent back over tls then
+func secureCookies(c *gin.Context) bool {
+	return c.Request.TLS != nil || strings.HasPrefix(strings.ToLower(*publicUrl), "https://")
+}
+
+// loginRedirect returns next if it is a path on this server, "/" otherwise. A value with a scheme or host, a
+// protocol-relative //host or a backslash, that browsers treat as a slash, would send the user to another site.
+func loginRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/"
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return next
+}
+
+// SetupAuthRouter setup the login pages and the user and token apis
+func SetupAuthRouter(router gin.IRouter) {
+	router.GET("/login", func(c *gin.Context) {
+		data := createDefaultPageData("dumpr! login", nil)
+		data["next"] = loginRedirect(c.DefaultQuery("next", "/"))
+		c.HTML(http.StatusOK, "login", data)
+	})
+
+	router.POST("/login", func(c *gin.Context) {
+		next := loginRedirect(c.DefaultPostForm("next", "/"))
+
+		user, ok := Auth.Login(c.PostForm("user"), c.PostForm("password"))
+		if !ok {
+			data := createDefaultPageData("dumpr! login", nil)
+			data["next"] = next
+			data["error"] = "invalid user or password"
+			c.HTML(http.StatusUnauthorized, "login", data)
+			return
+		}
+
+		raw := make([]byte, 32)
+		_, err := rand.Read(raw)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "unable to create login")
+			return
+		}
+		id := hex.EncodeToString(raw)
+
+		loginsMu.Lock()
+		logins[id] = &login{identity: &Identity{Name: user.Name, Role: user.Role}, expires: time.Now().Add(loginTTL)}
+		loginsMu.Unlock()
+
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(loginCookie, id, int(loginTTL.Seconds()), "/", "", secureCookies(c), true)
+		c.Redirect(http.StatusFound, next)
+	})
+
+	router.GET("/logout", func(c *gin.Context) {
+		if id, err := c.Cookie(loginCookie); err == nil {
+			loginsMu.Lock()
+			delete(logins, id)
+			loginsMu.Unlock()
+		}
+		c.SetCookie(loginCookie, "", -1, "/", "", secureCookies(c), true)
+		c.Redirect(http.StatusFound, "/login")
+	})
+
+	router.GET("/api/auth/users", func(c *gin.Context) {
+		c.JSON(200, Auth.Users())
+	})
+
+	router.POST("/api/auth/users", func(c *gin.Context) {
+		var payload struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.BindJSON(&payload); err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_USER", "message": "unable to parse json"})
+			return
+		}
+
+		role, err := ParseRole(payload.Role)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_USER", "message": err.Error()})
+			return
+		}
+
+		_, err = Auth.AddUser(payload.Name, payload.Password, role)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_USER", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "message": fmt.Sprintf("user [%s] added", payload.Name)})
+	})
+
+	router.DELETE("/api/auth/users/:user", func(c *gin.Context) {
+		err := Auth.RemoveUser(c.Param("user"))
+		if err != nil {
+			c.JSON(404, gin.H{"result": "failed", "code": "USER_NOT_FOUND", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "message": fmt.Sprintf("user [%s] removed", c.Param("user"))})
+	})
+
+	router.GET("/api/auth/tokens", func(c *gin.Context) {
+		c.JSON(200, Auth.Tokens())
+	})
+
+	router.POST("/api/auth/tokens", func(c *gin.Context) {
+		var payload struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if err := c.BindJSON(&payload); err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_TOKEN", "message": "unable to parse json"})
+			return
+		}
+
+		role, err := ParseRole(payload.Role)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_TOKEN", "message": err.Error()})
+			return
+		}
+
+		value, token, err := Auth.CreateToken(payload.Name, role)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_TOKEN", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "token": value, "name": token.Name, "role": token.Role})
+	})
+
+	router.DELETE("/api/auth/tokens/:token", func(c *gin.Context) {
+		err := Auth.RevokeToken(c.Param("token"))
+		if err != nil {
+			c.JSON(404, gin.H{"result": "failed", "code": "TOKEN_NOT_FOUND", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "message": fmt.Sprintf("token [%s] revoked", c.Param("token"))})
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// setupTestAuth enables --auth with an admin user alice, a read token and the bin team1 protected by a secret, returns
+// the url of the router and the read token
+func setupTestAuth(t *testing.T) (string, string) {
+	t.Helper()
+	setupTestServer(t)
+
+	*authEnabled = true
+	Auth = &AuthStore{users: make(map[string]*User), tokens: make(map[string]*APIToken)}
+	t.Cleanup(func() {
+		*authEnabled = false
+	})
+
+	_, err := Auth.AddUser("alice", "secret", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := Auth.CreateToken("ci", RoleRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Bin{{Name: "team1", Secret: "team1-secret"}, {Name: "team2"}} {
+		err = Bins.Put(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return serveTestRouter(t), token
+}
+
+// authRequest sends the request without following redirects and returns the response
+func authRequest(t *testing.T, method, target string, header http.Header) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	return res
+}
+
+func TestAuthRoles(t *testing.T) {
+	routerURL, token := setupTestAuth(t)
+
+	bearer := http.Header{"Authorization": {"Bearer " + token}}
+	basic := http.Header{"Authorization": {"Basic " + basicAuth("alice", "secret")}}
+	for _, tc := range []struct {
+		method, path string
+		header       http.Header
+		want         int
+	}{
+		{http.MethodGet, "/api/list/sessions", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/api/list/sessions", bearer, http.StatusOK},
+		{http.MethodGet, "/api/auth/users", bearer, http.StatusForbidden},
+		{http.MethodDelete, "/api/bins/team2", bearer, http.StatusForbidden},
+		{http.MethodGet, "/api/auth/users", basic, http.StatusOK},
+		{http.MethodDelete, "/api/bins/team2", basic, http.StatusOK},
+		{http.MethodGet, "/", nil, http.StatusFound},
+	} {
+		res := authRequest(t, tc.method, routerURL+tc.path, tc.header)
+		if res.StatusCode != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestAuthBinSecret(t *testing.T) {
+	routerURL, _ := setupTestAuth(t)
+
+	secret := http.Header{"X-Bin-Secret": {"team1-secret"}}
+	for _, tc := range []struct {
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"/api/bins/team1/list/sessions", secret, http.StatusOK},
+		{"/api/bins/team1/list/sessions?secret=team1-secret", nil, http.StatusOK},
+		{"/api/bins/team1/list/sessions", http.Header{"X-Bin-Secret": {"wrong"}}, http.StatusUnauthorized},
+		{"/api/bins/team2/list/sessions", secret, http.StatusUnauthorized},
+		{"/api/list/sessions", secret, http.StatusUnauthorized},
+	} {
+		res := authRequest(t, http.MethodGet, routerURL+tc.path, tc.header)
+		if res.StatusCode != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestLoginRedirect(t *testing.T) {
+	for next, want := range map[string]string{
+		"/v/abc?format=hex":  "/v/abc?format=hex",
+		"":                   "/",
+		"https://evil.com/":  "/",
+		"//evil.com":         "/",
+		"/\\evil.com":        "/",
+		"\\\\evil.com":       "/",
+		"/\t/evil.com":       "/",
+		"javascript:alert()": "/",
+	} {
+		if got := loginRedirect(next); got != want {
+			t.Errorf("loginRedirect(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestLoginCookie(t *testing.T) {
+	routerURL, _ := setupTestAuth(t)
+	defer func(v string) {
+		*publicUrl = v
+	}(*publicUrl)
+	*publicUrl = "https://dumpr.example.com"
+
+	form := url.Values{"user": {"alice"}, "password": {"secret"}, "next": {"/\\evil.com"}}
+	req, err := http.NewRequest(http.MethodPost, routerURL+"/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if location := res.Header.Get("Location"); location != "/" {
+		t.Errorf("redirected to %q, want /", location)
+	}
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginCookie || !cookies[0].Secure {
+		t.Errorf("cookies = %v, want a secure %s cookie", cookies, loginCookie)
+	}
+}
+
+func basicAuth(user, password string) string {
+	req := &http.Request{Header: make(http.Header)}
+	req.SetBasicAuth(user, password)
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Basic ")
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Alex jeannopoulos. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// SetupBinRouter setup the capture, view and api routes of the named bins
+func SetupBinRouter(router gin.IRouter) {
+
+	capture := func(c *gin.Context) {
+		path := c.Param("path")
+		if path == "" {
+			path = "/"
+		}
+
+		// the bin prefix is not part of the captured request, responders and resends see the path within the bin
+		c.Request.URL.Path = path
+		c.Request.URL.RawPath = ""
+		c.Request.RequestURI = c.Request.URL.RequestURI()
+		captureHTTP(c, c.Param("bin"))
+	}
+	router.Any("/b/:bin", capture)
+	router.Any("/b/:bin/*path", capture)
+
+	router.GET("/bins/:bin", func(c *gin.Context) {
+		bin, err := Bins.GetOrTag(c.Param("bin"))
+		if err != nil {
+			c.String(http.StatusNotFound, "bin not found")
+			return
+		}
+
+		data := createDefaultPageData(fmt.Sprintf("Bin %s", bin.Name), nil)
+		data["bin"] = bin
+		data["publicUrl"] = bin.URL()
+		data["listUrl"] = fmt.Sprintf("/api/bins/%s/list/sessions", bin.Name)
+		data["streamUrl"] = fmt.Sprintf("/api/bins/%s/stream", bin.Name)
+		data["autoResponderCount"] = autoResponders.Size() + len(bin.Responders)
+		if bin.RetentionDuration() > 0 {
+			data["purgeOlderThan"] = bin.RetentionDuration().String()
+		}
+		c.HTML(http.StatusOK, "index", data)
+	})
+
+	router.GET("/api/bins", func(c *gin.Context) {
+		list := make([]*Bin, 0)
+		for _, b := range Bins.List() {
+			list = append(list, b.Public())
+		}
+		c.JSON(200, list)
+	})
+
+	router.POST("/api/bins", func(c *gin.Context) {
+		var payload Bin
+		if err := c.BindJSON(&payload); err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_BIN", "message": "unable to parse json"})
+			return
+		}
+
+		if _, ok := Bins.Get(payload.Name); ok {
+			c.JSON(409, gin.H{"result": "failed", "code": "BIN_EXISTS", "message": fmt.Sprintf("bin [%s] already exists", payload.Name)})
+			return
+		}
+
+		err := Bins.Put(&payload)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_BIN", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "bin": payload.Public(), "url": payload.URL()})
+	})
+
+	router.GET("/api/bins/:bin", func(c *gin.Context) {
+		bin, ok := Bins.Get(c.Param("bin"))
+		if !ok {
+			c.JSON(404, gin.H{"code": "BIN_NOT_FOUND", "message": "Bin not found"})
+			return
+		}
+		c.JSON(200, bin.Public())
+	})
+
+	router.PUT("/api/bins/:bin", func(c *gin.Context) {
+		var payload Bin
+		if err := c.BindJSON(&payload); err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_BIN", "message": "unable to parse json"})
+			return
+		}
+
+		payload.Name = c.Param("bin")
+		err := Bins.Put(&payload)
+		if err != nil {
+			c.JSON(400, gin.H{"result": "failed", "code": "INVALID_BIN", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "bin": payload.Public(), "url": payload.URL()})
+	})
+
+	router.DELETE("/api/bins/:bin", func(c *gin.Context) {
+		name := c.Param("bin")
+		if _, ok := Bins.Get(name); !ok {
+			c.JSON(404, gin.H{"result": "failed", "code": "BIN_NOT_FOUND", "message": "Bin not found"})
+			return
+		}
+
+		err := Bins.Delete(name)
+		if err != nil {
+			c.JSON(500, gin.H{"result": "failed", "code": "BIN_DELETE_FAILED", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "message": fmt.Sprintf("bin [%s] deleted", name)})
+	})
+
+	router.GET("/api/bins/:bin/list/sessions", func(c *gin.Context) {
+		ServeSessionList(c, binFilter(c.Param("bin"), nil))
+	})
+
+	router.GET("/api/bins/:bin/list/active", func(c *gin.Context) {
+		ServeSessionList(c, binFilter(c.Param("bin"), (*Session).IsActive))
+	})
+
+	router.GET("/api/bins/:bin/list/inactive", func(c *gin.Context) {
+		ServeSessionList(c, binFilter(c.Param("bin"), func(s *Session) bool {
+			return !s.IsActive()
+		}))
+	})
+
+	router.GET("/api/bins/:bin/stream", broker.ServeFiltered(func(c *gin.Context, event NotificationEvent) bool {
+		return event.Name == KeepAlive || event.Bin == strings.ToLower(c.Param("bin"))
+	}))
+}
@@ -47,8 +47,17 @@ func SetupSSERouter(router gin.IRouter, path string) {
 	router.GET(path, broker.ServeHTTP)
 }
 
-// Broadcast an event to clients listening
+// Broadcast an event to clients listening, the bin of an ApiSession payload is the bin of the event
 func Broadcast(name EventName, payload interface{}) {
+	bin := ""
+	if session, ok := payload.(*ApiSession); ok {
+		bin = session.Bin
+	}
+	BroadcastBin(name, payload, bin)
+}
+
+// BroadcastBin broadcasts an event of a session captured in bin, the bin streams are only sent the events of their bin
+func BroadcastBin(name EventName, payload interface{}, bin string) {
 	if broker == nil {
 		return
 	}
@@ -57,6 +66,7 @@ func Broadcast(name EventName, payload interface{}) {
 	broker.Notifier <- NotificationEvent{
 		Name:    name,
 		Payload: payload,
+		Bin:     bin,
 	}
 }
 
@@ -70,6 +80,8 @@ type (
 	NotificationEvent struct {
 		Name    EventName
 		Payload interface{}
+		// Bin the bin of the session of the event, it is not sent to clients
+		Bin string
 	}
 
 	// NotifierChan channel for events to be passed
@@ -112,6 +124,17 @@ func NewBroker() (broker *Broker) {
 
 // ServeHTTP main handler of clients.
 func (broker *Broker) ServeHTTP(c *gin.Context) {
+	broker.serve(c, nil)
+}
+
+// ServeFiltered returns a handler of clients that are only sent the events accepted by filter.
+func (broker *Broker) ServeFiltered(filter func(c *gin.Context, event NotificationEvent) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		broker.serve(c, filter)
+	}
+}
+
+func (broker *Broker) serve(c *gin.Context, filter func(c *gin.Context, event NotificationEvent) bool) {
 	url := c.FullPath()
 	fmt.Printf("[%s] Requested topic: %s\n", c.ClientIP(), url)
 
@@ -136,6 +159,9 @@ func (broker *Broker) ServeHTTP(c *gin.Context) {
 	c.Stream(func(w io.Writer) bool {
 		// Emit Server Sent Events compatible
 		event := <-messageChan
+		if filter != nil && !filter(c, event) {
+			return true
+		}
 		c.SSEvent(event.Name.String(), event.Payload)
 		// Flush the data immediately instead of buffering it for later.
 		c.Writer.Flush()
@@ -179,7 +205,7 @@ func (broker *Broker) Listen() {
 func (broker *Broker) KeepAlive() {
 
 	for {
-		event := NotificationEvent{KeepAlive, ""}
+		event := NotificationEvent{Name: KeepAlive, Payload: ""}
 
 		for clientMessageChan := range broker.clients {
 			select {
@@ -5,19 +5,22 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/foolin/goview"
 	"github.com/foolin/goview/supports/ginview"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/render"
 	"gopkg.in/olahol/melody.v1"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func createDefaultPageData(pageName string, session *Session) gin.H {
@@ -29,9 +32,8 @@ func createDefaultPageData(pageName string, session *Session) gin.H {
 		"maxSessionSize":          maxSessionSize,
 		"maxSessionSizeFormatted": maxSessionSizeFormatted,
 		"autoResponderCount":      autoResponders.Size(),
-		"Sessions":                GetAllSessions(),
-		"ActiveSessions":          GetActiveSessions(),
-		"InActiveSessions":        GetInActiveSessions(),
+		"listUrl":                 "/api/list/sessions",
+		"streamUrl":               "/stream",
 		"BuildDate":               BuildDate,
 		"GitRepo":                 GitRepo,
 		"BuiltBy":                 BuiltBy,
@@ -68,7 +70,23 @@ func NewCustomWriter() io.Writer {
 }
 
 // GinServer launch gin server
-func GinServer() (err error) {
+func GinServer() error {
+	router, err := NewRouter()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := router.Run(fmt.Sprintf("%s:%d", *serverHost, *httpPort))
+		if err != nil {
+			log.Fatalf("Error starting server, the error is '%v'", err)
+		}
+	}()
+	return nil
+}
+
+// NewRouter returns the router of the web ui and the api, a request no route matches is captured as a http session
+func NewRouter() (*gin.Engine, error) {
 	//gin.DefaultWriter= NewCustomWriter()
 	//gin.DefaultErrorWriter= NewCustomWriter()
 	gin.SetMode(gin.ReleaseMode)
@@ -78,30 +96,45 @@ func GinServer() (err error) {
 
 	router := gin.Default()
 
+	// X-Forwarded-For and X-Real-IP are only honored when sent by a --trustedProxy
+	err := router.SetTrustedProxies(*trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	router.MaxMultipartMemory = MaxMultipartMemory
 
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
 	router.Use(cors.New(config))
 
+	router.Use(func(c *gin.Context) {
+		bin := BinFromHost(c.Request.Host)
+		if bin == "" {
+			return
+		}
+		captureHTTP(c, bin)
+		c.Abort()
+	})
+
+	router.Use(AuthMiddleware())
+
 	// templateConfig engine config
 	templateConfig := goview.Config{
 		Root:         "",
 		Extension:    ".html",
 		Master:       "layouts/master",
-		Partials:     []string{"partials/howto"},
+		Partials:     []string{"partials/howto", "partials/annotations", "partials/compare"},
 		Funcs:        make(template.FuncMap),
 		DisableCache: true,
 		Delims:       goview.Delims{Left: "{{", Right: "}}"},
 	}
 
 	templateConfig.Funcs["FileSize"] = func(fileName string) string {
-		fi, err := os.Stat(fileName)
+		size, err := store.Blobs().Size(fileName)
 		if err != nil {
 			return err.Error()
 		}
-		// get the size
-		size := fi.Size()
 
 		return ByteCountDecimal(size)
 	}
@@ -110,6 +143,14 @@ func GinServer() (err error) {
 		return a + b
 	}
 
+	templateConfig.Funcs["JSON"] = func(v interface{}) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err.Error()
+		}
+		return string(raw)
+	}
+
 	//new template engine
 	templateEngine := ginview.New(templateConfig)
 	templateEngine.SetFileHandler(func(config goview.Config, tplFileBaseName string) (content string, err error) {
@@ -150,28 +191,81 @@ func GinServer() (err error) {
 	})
 
 	router.GET("/api/list/active", func(ctx *gin.Context) {
-		ctx.JSON(200, GetActiveSessions())
+		ServeSessionList(ctx, (*Session).IsActive)
 	})
 	router.GET("/api/list/inactive", func(ctx *gin.Context) {
-		ctx.JSON(200, GetInActiveSessions())
+		ServeSessionList(ctx, func(s *Session) bool {
+			return !s.IsActive()
+		})
 	})
 
 	router.GET("/api/list/sessions", func(ctx *gin.Context) {
-		ctx.JSON(200, GetAllSessions())
+		ServeSessionList(ctx, nil)
+	})
+
+	router.GET("/api/retention", func(ctx *gin.Context) {
+		ctx.JSON(200, GetRetentionStatus())
+	})
+
+	router.GET("/api/search", func(ctx *gin.Context) {
+		query, err := ParseSearchQuery(ctx.Request.URL.Query())
+		if err != nil {
+			ctx.JSON(400, gin.H{"result": "failed", "code": "INVALID_SEARCH", "message": err.Error()})
+			return
+		}
+		ctx.JSON(200, Search(query))
 	})
 
 	router.GET("/api/info/:name", func(ctx *gin.Context) {
 
 		name := ctx.Param("name")
-		sess, _ := Sessions[name]
+		sess, _ := Sessions.Get(name)
 
 		if sess != nil {
-			ctx.JSON(200, sess)
+			// marshalled under the session lock, the session may still be capturing
+			ctx.Data(200, "application/json; charset=utf-8", sess.Bytes())
 		} else {
 			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
 		}
 	})
 
+	router.PATCH("/api/info/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		sess, ok := Sessions.Get(name)
+		if !ok {
+			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
+			return
+		}
+
+		var payload SessionAnnotations
+		if err := ctx.BindJSON(&payload); err != nil {
+			ctx.JSON(400, gin.H{"result": "failed", "code": "INVALID_ANNOTATION", "message": "unable to parse json"})
+			return
+		}
+
+		err := sess.Annotate(&payload)
+		if err != nil {
+			ctx.JSON(400, gin.H{"result": "failed", "code": "INVALID_ANNOTATION", "message": err.Error()})
+			return
+		}
+		ctx.JSON(200, sess.ToApiSession())
+	})
+
+	router.DELETE("/api/info/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		sess, ok := Sessions.Get(name)
+		if !ok {
+			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
+			return
+		}
+
+		if sess.IsActive() {
+			deactivateSession(sess)
+		}
+		PurgeSession(sess)
+		ctx.JSON(200, gin.H{"result": "success", "code": "SUCCESS", "message": fmt.Sprintf("session [%s] purged", name)})
+	})
+
 	router.GET("/api/autoresponder/:name", func(ctx *gin.Context) {
 
 		name := ctx.Param("name")
@@ -320,10 +414,89 @@ func GinServer() (err error) {
 		ctx.JSON(200, autoResponders.l)
 	})
 
+	router.POST("/api/replay/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		src, ok := Sessions.Get(name)
+		if !ok {
+			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
+			return
+		}
+
+		var payload struct {
+			ReplayOptions
+			Wait string `json:"wait"`
+		}
+		if err := ctx.BindJSON(&payload); err != nil {
+			ctx.JSON(400, gin.H{"result": "failed", "code": "REPLAY_FAILED", "message": "unable to parse json"})
+			return
+		}
+
+		opts := &payload.ReplayOptions
+		if payload.Wait != "" {
+			wait, err := time.ParseDuration(payload.Wait)
+			if err != nil {
+				ctx.JSON(400, gin.H{"result": "failed", "code": "REPLAY_FAILED", "message": fmt.Sprintf("invalid wait: %v", err)})
+				return
+			}
+			opts.Wait = wait
+		}
+
+		session, err := ReplaySession(src, opts)
+		if err != nil {
+			ctx.JSON(500, gin.H{"result": "failed", "code": "REPLAY_FAILED", "message": err.Error()})
+			return
+		}
+
+		ctx.JSON(200, createNewSessionResponse(session))
+	})
+
+	router.POST("/api/resend/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		session, ok := Sessions.Get(name)
+		if !ok {
+			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
+			return
+		}
+
+		var opts ResendOptions
+		if err := ctx.BindJSON(&opts); err != nil {
+			ctx.JSON(400, gin.H{"result": "failed", "code": "RESEND_FAILED", "message": "unable to parse json"})
+			return
+		}
+
+		result, err := ResendSession(session, &opts)
+		if errors.Is(err, ErrResendRedacted) {
+			ctx.JSON(409, gin.H{"result": "failed", "code": "RESEND_REDACTED", "message": err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(500, gin.H{"result": "failed", "code": "RESEND_FAILED", "message": err.Error()})
+			return
+		}
+		ctx.JSON(200, result)
+	})
+
+	router.GET("/api/resend/:name/:index", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		session, ok := Sessions.Get(name)
+		if !ok {
+			ctx.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "Session not found"})
+			return
+		}
+
+		index, _ := strconv.Atoi(ctx.Param("index"))
+		result, err := LoadResendResult(session, index)
+		if err != nil {
+			ctx.JSON(404, gin.H{"code": "RESEND_NOT_FOUND", "message": err.Error()})
+			return
+		}
+		ctx.JSON(200, result)
+	})
+
 	router.GET("/v/:name", func(c *gin.Context) {
 		name := c.Param("name")
 
-		session, ok := Sessions[name]
+		session, ok := Sessions.Get(name)
 
 		if !ok {
 			c.String(http.StatusNotFound, "session not found")
@@ -331,57 +504,96 @@ func GinServer() (err error) {
 		}
 		data := createDefaultPageData("session details!", session)
 
-		if session.Protocol == HTTP {
+		protocol := session.ProtocolType()
+		if protocol == HTTP {
 			c.HTML(http.StatusOK, "http_view", data)
+		} else if protocol == Mail {
+			c.HTML(http.StatusOK, "mail_view", data)
 		} else {
 			data["sse_url"] = "./ws"
 			c.HTML(http.StatusOK, "live_view", data)
 		}
 	})
 
+	router.GET("/api/mail/:name", func(c *gin.Context) {
+		session, ok := Sessions.Get(c.Param("name"))
+		if !ok || session.ProtocolType() != Mail || session.MailSession == nil {
+			c.JSON(404, gin.H{"code": "SESSION_NOT_FOUND", "message": "mail session not found"})
+			return
+		}
+		c.JSON(200, session.MailSession)
+	})
+
+	router.GET("/api/diff/:a/:b", func(c *gin.Context) {
+		diff, ok := diffParams(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, diff)
+	})
+
+	router.GET("/diff/:a/:b", func(c *gin.Context) {
+		diff, ok := diffParams(c)
+		if !ok {
+			return
+		}
+		data := createDefaultPageData("session diff", nil)
+		data["diff"] = diff
+		c.HTML(http.StatusOK, "diff_view", data)
+	})
+
 	router.GET("/t/:name/:filename", func(c *gin.Context) {
 		name := c.Param("name")
 		filename := c.Param("filename")
-		session, ok := Sessions[name]
+		session, ok := Sessions.Get(name)
 		if !ok {
 			c.String(http.StatusNotFound, "session not found")
 			return
 		}
 
-		fileInfo, ok := session.MultiPartFiles[filename]
+		fileInfo, ok := session.UploadedFile(filename)
 		if !ok {
 			c.String(http.StatusNotFound, "file not found")
 			return
 		}
-		c.File(fileInfo.File)
+		serveBlob(c, fileInfo.File, "")
 	})
 
 	router.GET("/t/:name", func(c *gin.Context) {
 		name := c.Param("name")
-		session, ok := Sessions[name]
+		session, ok := Sessions.Get(name)
 		if !ok {
 			c.String(http.StatusNotFound, "session not found")
 			return
 		}
 
-		if session.Protocol == HTTP {
-			c.Header("Content-Type", "application/json; charset=utf-8")
+		format, err := ParseRenderFormat(c.Query("format"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"result": "failed", "code": "INVALID_FORMAT", "message": err.Error()})
+			return
+		}
+		if format != RenderText {
+			serveRendered(c, session.SaveFile, format)
+			return
+		}
+
+		if session.ProtocolType() == HTTP {
 			c.Header("Cache-Control", "no-cache")
-			c.File(session.SaveFile)
+			serveBlob(c, session.SaveFile, "application/json; charset=utf-8")
 		} else {
-			c.File(session.SaveFile)
+			serveBlob(c, session.SaveFile, "")
 		}
 	})
 
 	router.GET("/t/:name/body", func(c *gin.Context) {
 		name := c.Param("name")
-		session, ok := Sessions[name]
+		session, ok := Sessions.Get(name)
 		if !ok {
 			c.String(http.StatusNotFound, "session not found")
 			return
 		}
 
-		if session.Protocol == HTTP && session.HTTPSession != nil && session.HTTPSession.Body != nil {
+		if session.ProtocolType() == HTTP && session.HTTPSession != nil && session.HTTPSession.Body != nil {
 			c.Header("Cache-Control", "no-cache")
 			responseType := "application/json; charset=utf-8"
 
@@ -397,9 +609,68 @@ func GinServer() (err error) {
 		}
 	})
 
+	router.GET("/t/:name/curl", func(c *gin.Context) {
+		session, ok := httpSessionParam(c)
+		if !ok {
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.String(http.StatusOK, session.CurlCommand())
+	})
+
+	router.GET("/t/:name/raw", func(c *gin.Context) {
+		session, ok := httpSessionParam(c)
+		if !ok {
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/octet-stream", session.RawRequest())
+	})
+
+	router.GET("/t/:name/har", func(c *gin.Context) {
+		session, ok := httpSessionParam(c)
+		if !ok {
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.har", session.Key))
+		c.JSON(http.StatusOK, NewHAR([]*Session{session}))
+	})
+
+	router.GET("/api/export/har", func(c *gin.Context) {
+		sessions, err := ExportFilter(c.Request.URL.Query())
+		if err != nil {
+			c.JSON(400, gin.H{"code": "INVALID_FILTER", "message": err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=dumpr.har")
+		c.JSON(http.StatusOK, NewHAR(sessions))
+	})
+
+	router.GET("/t/:name/timeline", func(c *gin.Context) {
+		name := c.Param("name")
+		session, ok := Sessions.Get(name)
+		if !ok {
+			c.String(http.StatusNotFound, "session not found")
+			return
+		}
+
+		frames, err := session.Frames(c.DefaultQuery("data", "true") != "false")
+		if err != nil {
+			c.JSON(500, gin.H{"code": "TIMELINE_READ_FAILED", "message": err.Error()})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.JSON(200, gin.H{
+			"key":       session.Key,
+			"startTime": session.StartTime,
+			"frames":    frames,
+		})
+	})
+
 	router.GET("/v/:name/ws", func(c *gin.Context) {
 		name := c.Param("name")
-		session, ok := Sessions[name]
+		session, ok := Sessions.Get(name)
 		if !ok {
 			c.String(http.StatusNotFound, "session not found")
 			return
@@ -424,46 +695,11 @@ func GinServer() (err error) {
 		ctx.HTML(http.StatusOK, "responders", data)
 	})
 	SetupSSERouter(router, "/stream")
+	SetupBinRouter(router)
+	SetupAuthRouter(router)
 
 	router.NoRoute(func(c *gin.Context) {
-		session, err := createSession(c.ClientIP())
-
-		if err != nil {
-			c.JSON(500, gin.H{"code": "CREATE_SESSION_FAILED",
-				"message": err.Error(),
-			})
-			return
-		}
-
-		session.InitializeHTTP(c.Request)
-
-		c.Header("X-Session-Key", session.Key)
-		url := fmt.Sprintf("%s/t/%s", *publicUrl, session.Key)
-		c.Header("X-Session-URL", url)
-		url = fmt.Sprintf("%s/api/info/%s", *publicUrl, session.Key)
-		c.Header("X-Session-Info-URL", url)
-
-		autoResponse := autoResponders.Find(c.Request)
-		if autoResponse != nil {
-			session.HandledByRule = autoResponse.Name
-		}
-		deactivateSession(session)
-
-		if autoResponse != nil {
-			c.Header("X-AutoResponder-Name", autoResponse.Name)
-			if autoResponse.ResponseHeaders != nil {
-				for k, v := range autoResponse.ResponseHeaders {
-					c.Header(k, v)
-				}
-			}
-
-			payload := []byte(autoResponse.Response)
-			c.Data(autoResponse.StatusCode, autoResponse.ContentType, payload)
-		} else {
-			sessionInfo := createNewSessionResponse(session)
-			c.Render(200, render.JSON{Data: sessionInfo})
-		}
-
+		captureHTTP(c, "")
 	})
 
 	m.HandleConnect(func(s *melody.Session) {
@@ -480,34 +716,18 @@ func GinServer() (err error) {
 			panic("Unable to cast s.Keys[\"session\"] to *Session ")
 		}
 
-		historyFile, err := os.Open(session.SaveFile)
+		format, err := ParseRenderFormat(s.Request.URL.Query().Get("format"))
 		if err != nil {
-			_ = s.CloseWithMsg([]byte("unable to read file"))
-			return
+			format = RenderText
 		}
-		defer func() {
-			_ = historyFile.Close() //Do not forget to close the file
-		}()
 
-		bytesSent := 0
-		r := bufio.NewReader(historyFile)
-		for {
-			buf := make([]byte, 4*1024) //the chunk size
-			n, err := r.Read(buf)       //loading chunk into buffer
-			buf = buf[:n]
-			if n == 0 {
-				if err != nil {
-					break
-				}
-				if err == io.EOF {
-					break
-				}
-			}
-			bytesSent += len(buf)
-			_ = s.Write(buf)
+		err = session.Watch(s, format, func(frame *ViewFrame) error {
+			return writeFrame(s, frame)
+		})
+		if err != nil {
+			_ = s.CloseWithMsg([]byte("unable to read file"))
+			return
 		}
-		//fmt.Printf("HandleConnect: name: %s bytesSent: %d\n", name, bytesSent)
-		session.Viewers = append(session.Viewers, s)
 	})
 
 	m.HandleDisconnect(func(s *melody.Session) {
@@ -524,24 +744,157 @@ func GinServer() (err error) {
 			panic("Unable to cast s.Keys[\"session\"] to *Session ")
 		}
 
-		session.Viewers = removeElement(session.Viewers, s)
+		session.RemoveViewer(s)
 		//fmt.Printf("HandleDisconnect: name: %s viewer cnd: %d file: %s\n", name, len(session.Viewers), session.SaveFile)
 	})
 
+	// a viewer switches the render format with {"type": "format", "format": "hex"}, the history is sent again in the
+	// new format on the same connection
 	m.HandleMessage(func(s *melody.Session, msg []byte) {
-		_ = m.BroadcastFilter(msg, func(q *melody.Session) bool {
-			return q.Request.URL.Path == s.Request.URL.Path
+		var request viewRequest
+		if json.Unmarshal(msg, &request) != nil || request.Type != "format" {
+			return
+		}
+
+		format, err := ParseRenderFormat(request.Format)
+		if err != nil {
+			_ = writeFrame(s, &ViewFrame{Type: FrameStatus, Content: err.Error()})
+			return
+		}
+
+		sessionObj, ok := s.Keys["session"]
+		if !ok {
+			return
+		}
+		session, ok := sessionObj.(*Session)
+		if !ok {
+			return
+		}
+
+		err = session.Watch(s, format, func(frame *ViewFrame) error {
+			return writeFrame(s, frame)
 		})
+		if err != nil {
+			_ = writeFrame(s, &ViewFrame{Type: FrameStatus, Content: "unable to read file"})
+			return
+		}
 	})
 
-	go func() {
-		err = router.Run(fmt.Sprintf("%s:%d", *serverHost, *httpPort))
+	return router, nil
+}
+
+// captureHTTP captures the request as a http session of the bin and writes the session response
+func captureHTTP(c *gin.Context, bin string) {
+	if bin != "" {
+		b, err := Bins.GetOrTag(bin)
 		if err != nil {
-			log.Fatalf("Error starting server, the error is '%v'", err)
+			c.JSON(400, gin.H{"code": "INVALID_BIN", "message": err.Error()})
+			return
 		}
+		bin = b.Name
+	}
+
+	session, err := createBinSession(c.RemoteIP(), bin)
+	if err != nil {
+		c.JSON(500, gin.H{"code": "CREATE_SESSION_FAILED",
+			"message": err.Error(),
+		})
+		return
+	}
+	if ip := c.ClientIP(); ip != c.RemoteIP() {
+		session.SetClientIP(ip)
+	}
+
+	session.InitializeHTTP(c.Request)
+
+	res, autoResponse := NewSessionResponse(session, c.Request)
+	res.Header["X-Session-URL"] = []string{fmt.Sprintf("%s/t/%s", *publicUrl, session.Key)}
+	session.SetHTTPResponse(res, autoResponse)
+	deactivateSession(session)
+
+	for k, v := range res.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Data(res.StatusCode, http.Header(res.Header).Get("Content-Type"), res.Body)
+}
+
+// serveBlob writes a session blob to the response, the content type is taken from the blob name if not set
+func serveBlob(c *gin.Context, name, contentType string) {
+	size, err := store.Blobs().Size(name)
+	if err != nil {
+		c.String(http.StatusNotFound, "file not found")
+		return
+	}
+
+	r, err := store.Blobs().Open(name)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer func() {
+		_ = r.Close()
 	}()
 
-	return
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, io.LimitReader(r, size), nil)
+}
+
+// serveRendered writes the blob rendered in format as text
+func serveRendered(c *gin.Context, name, format string) {
+	r, err := store.Blobs().Open(name)
+	if err != nil {
+		c.String(http.StatusNotFound, "file not found")
+		return
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	_ = WriteRendered(c.Writer, format, r)
+}
+
+// httpSessionParam returns the http session named in the request path, writes a 404 if it is not found
+func httpSessionParam(c *gin.Context) (*Session, bool) {
+	name := c.Param("name")
+	session, ok := Sessions.Get(name)
+	if !ok {
+		c.String(http.StatusNotFound, "session not found")
+		return nil, false
+	}
+
+	if session.ProtocolType() != HTTP || session.HTTPSession == nil {
+		c.String(http.StatusNotFound, "http session not found")
+		return nil, false
+	}
+	return session, true
+}
+
+// diffParams returns the diff of the sessions named by the a and b route params, writes the error response on failure
+func diffParams(c *gin.Context) (*SessionDiff, bool) {
+	a, ok := Sessions.Get(c.Param("a"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"result": "failed", "code": "SESSION_NOT_FOUND", "message": fmt.Sprintf("session %s not found", c.Param("a"))})
+		return nil, false
+	}
+	b, ok := Sessions.Get(c.Param("b"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"result": "failed", "code": "SESSION_NOT_FOUND", "message": fmt.Sprintf("session %s not found", c.Param("b"))})
+		return nil, false
+	}
+
+	diff, err := DiffSessions(a, b)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed", "code": "DIFF_FAILED", "message": err.Error()})
+		return nil, false
+	}
+	return diff, true
 }
 
 func removeElement(s []*melody.Session, session *melody.Session) []*melody.Session {